@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+)
+
+// DefaultTTL is how long a cached host is considered fresh.
+const DefaultTTL = 5 * time.Minute
+
+// entry is a cached host and when it was looked up
+type entry struct {
+	Host    *ts.TailscaleHost `json:"host"`
+	Updated time.Time         `json:"updated"`
+}
+
+// Cache stores resolved Tailscale hosts on disk.
+type Cache struct {
+	fs   afero.Fs
+	path string
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+// DefaultPath returns the default location of the cache file in the user
+// cache directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tailshale", "hosts.json"), nil
+}
+
+func New(fs afero.Fs, path string, ttl time.Duration) *Cache {
+	return &Cache{
+		fs:   fs,
+		path: path,
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// cacheKey normalizes the lookup name so "Host" and "host." share an entry.
+func cacheKey(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (c *Cache) load() map[string]entry {
+	entries := make(map[string]entry)
+	data, err := afero.ReadFile(c.fs, c.path)
+	if err != nil {
+		return entries
+	}
+	// A corrupt cache is treated as empty, it will be rewritten on the next
+	// successful lookup.
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return make(map[string]entry)
+	}
+	return entries
+}
+
+func (c *Cache) save(entries map[string]entry) error {
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write atomically so readers never see a partial cache.
+	return internal.WriteFileAtomic(c.fs, c.path, data, 0600)
+}
+
+// Get returns the cached host and whether it is still within the TTL. It
+// returns nil if the host is not cached.
+func (c *Cache) Get(host string) (*ts.TailscaleHost, bool) {
+	e, ok := c.load()[cacheKey(host)]
+	if !ok || e.Host == nil {
+		return nil, false
+	}
+	return e.Host, c.now().Sub(e.Updated) < c.ttl
+}
+
+// Put stores the host in the cache.
+func (c *Cache) Put(host string, tsHost *ts.TailscaleHost) error {
+	entries := c.load()
+	entries[cacheKey(host)] = entry{
+		Host:    tsHost,
+		Updated: c.now(),
+	}
+	return c.save(entries)
+}
+
+// Client looks up hosts through the cache, only connecting to tailscaled on a
+// cache miss or an expired entry.
+type Client struct {
+	cache    *Cache
+	connect  func() (ts.HostGetter, error)
+	upstream ts.HostGetter
+	// Warn receives warnings about stale cache use, defaults to os.Stderr
+	Warn io.Writer
+}
+
+var _ ts.HostGetter = (*Client)(nil) // Ensure Client can be used in place of a TSClient
+
+func NewClient(cache *Cache, connect func() (ts.HostGetter, error)) *Client {
+	return &Client{
+		cache:   cache,
+		connect: connect,
+		Warn:    os.Stderr,
+	}
+}
+
+// GetHost returns the host from the cache if it is fresh. Otherwise it is
+// looked up with tailscaled and cached. If tailscaled is unavailable the last
+// known host is returned with a warning.
+func (c *Client) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	cached, fresh := c.cache.Get(host)
+	if cached != nil && fresh {
+		return cached, nil
+	}
+
+	tsHost, err := c.lookup(ctx, host)
+	if err != nil {
+		if cached != nil && errors.Is(err, ts.ErrUnavailable) {
+			fmt.Fprintf(c.Warn, "Warning: %v, using cached host keys for %s\n", err, host)
+			return cached, nil
+		}
+		return tsHost, err
+	}
+
+	if err := c.cache.Put(host, tsHost); err != nil {
+		fmt.Fprintf(c.Warn, "Warning: failed to update host key cache: %v\n", err)
+	}
+	return tsHost, nil
+}
+
+func (c *Client) lookup(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	if c.upstream == nil {
+		upstream, err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+		c.upstream = upstream
+	}
+	return c.upstream.GetHost(ctx, host)
+}
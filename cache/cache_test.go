@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+const testPath = "/cache/tailshale/hosts.json"
+
+var testHost = &ts.TailscaleHost{
+	Name: "test.example.ts.net.",
+	IPs:  []netip.Addr{in.TEST_IP, in.TEST_IP6},
+	Keys: []ssh.PublicKey{
+		in.TEST_HOST_KEY_OBJECT,
+	},
+}
+
+type fakeGetter struct {
+	host  *ts.TailscaleHost
+	err   error
+	calls int
+}
+
+func (f *fakeGetter) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	f.calls++
+	return f.host, f.err
+}
+
+func TestCache_PutGet(t *testing.T) {
+	c := New(afero.NewMemMapFs(), testPath, time.Minute)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	host, _ := c.Get("test")
+	assert.Nil(t, host, "Empty cache should not return a host")
+
+	require.NoError(t, c.Put("test", testHost))
+
+	host, fresh := c.Get("TEST.")
+	require.NotNil(t, host)
+	assert.True(t, fresh)
+	assert.Equal(t, testHost.Name, host.Name)
+	assert.Equal(t, testHost.IPs, host.IPs)
+	assert.Equal(t, in.TEST_HOST_KEY_OBJECT.Marshal(), host.Keys[0].Marshal())
+
+	c.now = func() time.Time { return now.Add(2 * time.Minute) }
+	host, fresh = c.Get("test")
+	assert.NotNil(t, host, "Expired entries should still be returned")
+	assert.False(t, fresh)
+}
+
+func TestCache_Corrupt(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, testPath, []byte("not json"), 0600) //nolint:errcheck
+	c := New(fs, testPath, time.Minute)
+
+	host, _ := c.Get("test")
+	assert.Nil(t, host)
+	require.NoError(t, c.Put("test", testHost))
+	host, _ = c.Get("test")
+	assert.NotNil(t, host)
+}
+
+func TestClient_GetHost(t *testing.T) {
+	t.Run("Miss then hit", func(t *testing.T) {
+		upstream := &fakeGetter{host: testHost}
+		connects := 0
+		c := NewClient(New(afero.NewMemMapFs(), testPath, time.Minute), func() (ts.HostGetter, error) {
+			connects++
+			return upstream, nil
+		})
+
+		_, err := c.GetHost(context.TODO(), "test")
+		require.NoError(t, err)
+		host, err := c.GetHost(context.TODO(), "test")
+		require.NoError(t, err)
+		assert.Equal(t, testHost.Name, host.Name)
+		assert.Equal(t, 1, connects)
+		assert.Equal(t, 1, upstream.calls)
+	})
+
+	t.Run("Cache hit does not connect", func(t *testing.T) {
+		cache := New(afero.NewMemMapFs(), testPath, time.Minute)
+		require.NoError(t, cache.Put("test", testHost))
+		c := NewClient(cache, func() (ts.HostGetter, error) {
+			t.Fatal("tailscaled should not be contacted")
+			return nil, nil
+		})
+
+		host, err := c.GetHost(context.TODO(), "test")
+		require.NoError(t, err)
+		assert.Equal(t, testHost.Name, host.Name)
+	})
+
+	t.Run("Stale fallback when unavailable", func(t *testing.T) {
+		cache := New(afero.NewMemMapFs(), testPath, time.Minute)
+		require.NoError(t, cache.Put("test", testHost))
+		cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+		c := NewClient(cache, func() (ts.HostGetter, error) {
+			return nil, ts.ErrUnavailable
+		})
+		warn := &bytes.Buffer{}
+		c.Warn = warn
+
+		host, err := c.GetHost(context.TODO(), "test")
+		require.NoError(t, err)
+		assert.Equal(t, testHost.Name, host.Name)
+		assert.Contains(t, warn.String(), "using cached host keys")
+	})
+
+	t.Run("No fallback for other errors", func(t *testing.T) {
+		cache := New(afero.NewMemMapFs(), testPath, time.Minute)
+		require.NoError(t, cache.Put("test", testHost))
+		cache.now = func() time.Time { return time.Now().Add(time.Hour) }
+		c := NewClient(cache, func() (ts.HostGetter, error) {
+			return &fakeGetter{err: errors.New("ssh not enabled")}, nil
+		})
+
+		_, err := c.GetHost(context.TODO(), "test")
+		assert.Error(t, err)
+	})
+}
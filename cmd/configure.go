@@ -1,17 +1,27 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/evilhamsterman/tailshale/internal"
+	"github.com/pmezard/go-difflib/difflib"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
-var clean = false
+var (
+	clean          = false
+	include        = false
+	configDryRun   = false
+	checkConfig    = false
+	restoreConfig  = false
+	knownHostsFile string
+)
 
 var configureCmd = &cobra.Command{
 	Use:   "configure",
@@ -19,29 +29,150 @@ var configureCmd = &cobra.Command{
 	Long: strings.TrimLeft(`
 Configure the SSH client to automatically retrieve and validate host keys for
 Tailscale nodes with Tailscale SSH enabled. This command sets up the necessary
-configurations to allow seamless host key authentication for Tailscale nodes.`,
+configurations to allow seamless host key authentication for Tailscale nodes.
+
+By default the configuration is added to the SSH config file between marker
+comments. With --include it is written to its own file instead, and only an
+Include line for it is added to the top of the SSH config file.
+
+With --dry-run the changes are printed as a unified diff instead of being
+written. With --check nothing is written and the command exits non-zero if
+the configuration is missing or out of date.
+
+The block is added at the bottom of a new config and otherwise left where it
+is. OpenSSH uses the first value it finds for each option, so use --position
+to move it above your own Host sections: top, bottom, before:<section> or
+after:<section>, for example --position "before:Host *". Top puts it after
+any global options, so they still apply to every host. Options set earlier
+that stop the block from taking effect are reported as warnings.
+
+Files are replaced atomically and the previous version is kept as a hidden
+timestamped backup next to the file. The SSH config and the include file are
+backed up together, and --restore rolls both back to the most recent set.`,
 		"\n"),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if configDryRun && checkConfig {
+			return fmt.Errorf("--dry-run cannot be used with --check")
+		}
+		if restoreConfig && (configDryRun || checkConfig || clean) {
+			return fmt.Errorf("--restore cannot be used with --dry-run, --check or --clean")
+		}
+		return cobra.NoArgs(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		fs := afero.NewOsFs()
-		sshConfigPath := viper.GetString("ssh_config")
+		opts := ConfigureOptions{
+			SSHConfig:      viper.GetString("ssh_config"),
+			IncludeFile:    viper.GetString("configure.include_file"),
+			Include:        include,
+			KnownHostsFile: knownHostsFile,
+			Clean:          clean,
+			Backups:        viper.GetInt("configure.backups"),
+		}
+
+		placement, err := internal.ParsePlacement(viper.GetString("configure.position"))
+		if err != nil {
+			cmd.Println("Error:", err)
+			os.Exit(1)
+		}
+		opts.Placement = placement
+
+		if restoreConfig {
+			unlock, err := internal.LockConfigFile(fs, opts.SSHConfig)
+			if err != nil {
+				cmd.Println("Error locking SSH configuration:", err)
+				os.Exit(1)
+			}
+			defer unlock() //nolint:errcheck
+			paths := []string{opts.SSHConfig}
+			if opts.IncludeFile != "" {
+				paths = append(paths, opts.IncludeFile)
+			}
+			restored, err := internal.RestoreConfigFiles(fs, paths, opts.Backups)
+			if err != nil {
+				cmd.Println("Error restoring SSH configuration:", err)
+				os.Exit(1)
+			}
+			if restored == nil {
+				cmd.Println("No backups found for", opts.SSHConfig)
+				os.Exit(1)
+			}
+			for _, path := range paths {
+				if backup := restored[path]; backup != "" {
+					cmd.Printf("Restored %s from %s\n", path, backup)
+				} else {
+					cmd.Printf("Removed %s, it didn't exist at the time of the backup\n", path)
+				}
+			}
+			return
+		}
+
 		tailshaleCommand, err := os.Executable()
 		if err != nil {
 			cmd.Println("Error getting executable path:", err)
 			os.Exit(1)
 		}
+		opts.Command = tailshaleCommand
 
-		if clean {
-			if err := CleanSSHConfig(fs, sshConfigPath); err != nil {
-				cmd.Println("Error cleaning SSH configuration:", err)
+		// Hold the lock from reading the files until they are written, so a
+		// concurrent run can't change them in between. --dry-run and --check
+		// only read, so they don't need it and work on read-only configs.
+		if !configDryRun && !checkConfig {
+			unlock, err := internal.LockConfigFile(fs, opts.SSHConfig)
+			if err != nil {
+				cmd.Println("Error locking SSH configuration:", err)
 				os.Exit(1)
 			}
-			cmd.Println("SSH configuration cleaned")
-		} else {
-			if err := AddTailshaleConfig(fs, sshConfigPath, tailshaleCommand); err != nil {
-				cmd.Println("Error adding include line to SSH config:", err)
+			defer unlock() //nolint:errcheck
+		}
+
+		changes, err := PlanConfigure(fs, opts)
+		if err != nil {
+			cmd.Println("Error reading SSH configuration:", err)
+			if errors.Is(err, internal.ErrMalformedConfig) {
+				cmd.Println("Nothing was changed. Fix or remove the tailshale markers and run configure again.")
+			}
+			os.Exit(1)
+		}
+		for _, c := range changes {
+			for _, warning := range c.Warnings {
+				fmt.Fprintf(os.Stderr, "Warning: %s: %s\n", c.Path, warning)
+			}
+		}
+
+		if configDryRun {
+			for _, c := range changes {
+				fmt.Fprint(cmd.OutOrStdout(), c.Diff())
+			}
+			return
+		}
+		if checkConfig {
+			stale := false
+			for _, c := range changes {
+				if c.Changed() {
+					cmd.Println("Out of date:", c.Path)
+					stale = true
+				}
+			}
+			if stale {
 				os.Exit(1)
 			}
+			cmd.Println("SSH configuration is up to date")
+			return
+		}
 
+		if err := ApplyChanges(fs, changes, opts.Backups); err != nil {
+			cmd.Println("Error writing SSH configuration:", err)
+			os.Exit(1)
+		}
+		switch {
+		case clean:
+			cmd.Println("SSH configuration cleaned")
+		case include:
+			cmd.Printf("Configuration written to %s and included from %s.\n", opts.IncludeFile, opts.SSHConfig)
+		case knownHostsFile != "":
+			cmd.Printf("Configuration complete. Run \"%s sync --output %s\" to keep the file up to date.\n", tailshaleCommand, knownHostsFile)
+		default:
 			cmd.Println("Configuration complete. Your SSH client is now set up for Tailscale.")
 		}
 	},
@@ -49,72 +180,302 @@ configurations to allow seamless host key authentication for Tailscale nodes.`,
 
 func init() {
 	configureCmd.Flags().BoolVar(&clean, "clean", false, "Clean up the SSH configuration by removing the include line and the include file")
+	configureCmd.Flags().StringVar(&knownHostsFile, "known-hosts-file", "", "Use a known_hosts file written by the sync command instead of KnownHostsCommand")
+	configureCmd.Flags().BoolVar(&include, "include", false, "Write the config to its own file and include it from the SSH config")
+	configureCmd.Flags().String("include-file", "", "Path of the included config file (default ~/.ssh/config.d/tailshale.conf)")
+	viper.BindPFlag("configure.include_file", configureCmd.Flags().Lookup("include-file")) //nolint:errcheck
+	configureCmd.Flags().BoolVar(&configDryRun, "dry-run", false, "Print a diff of the changes instead of writing them")
+	configureCmd.Flags().BoolVar(&checkConfig, "check", false, "Exit non-zero if the configuration is missing or out of date")
+	configureCmd.Flags().BoolVar(&restoreConfig, "restore", false, "Restore the SSH configuration from the most recent backup")
+	configureCmd.Flags().Int("backups", 0, "Number of backups of each file to keep (default 5)")
+	viper.BindPFlag("configure.backups", configureCmd.Flags().Lookup("backups")) //nolint:errcheck
+	configureCmd.Flags().String("position", "", "Where to put the config block: top, bottom, before:<section> or after:<section> (default keeps the current position)")
+	viper.BindPFlag("configure.position", configureCmd.Flags().Lookup("position")) //nolint:errcheck
 	rootCmd.AddCommand(configureCmd)
 }
 
-// AddTailshaleConfig adds the include line to the SSH config file
-func AddTailshaleConfig(fs afero.Fs, sshConfPath, exePath string) error {
-	// Open the file, create it if it doesn't exist
-	sshConfFile, err := fs.OpenFile(sshConfPath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return fmt.Errorf("Error opening ssh config file: %w", err)
+// ConfigureOptions selects the changes made by configure
+type ConfigureOptions struct {
+	SSHConfig      string // Path of the SSH config file
+	IncludeFile    string // Path of the included config file
+	Include        bool   // Write the config to the include file
+	Command        string // Path of the tailshale executable
+	KnownHostsFile string // Use this static known_hosts file instead of KnownHostsCommand
+	Clean          bool   // Remove the config instead of adding it
+	Backups        int    // Number of backups of each file to keep
+	// Placement of the inline config block, unused with an include file
+	Placement internal.Placement
+}
+
+// FileChange is a planned change to a file
+type FileChange struct {
+	Path   string
+	Old    string // Current content, empty if the file doesn't exist
+	New    string
+	Exists bool // The file exists now
+	Remove bool // The file is deleted
+	// Warnings about the new content, such as options that override it
+	Warnings []string
+}
+
+// Changed reports whether applying the change modifies the file
+func (c FileChange) Changed() bool {
+	if c.Remove {
+		return c.Exists
 	}
-	defer sshConfFile.Close()
-	cfg, err := internal.NewSSHConfigFromFile(sshConfFile)
-	if err != nil {
-		return fmt.Errorf("Error reading ssh config file: %w", err)
+	return !c.Exists || c.Old != c.New
+}
+
+// Diff returns the change as a unified diff, or an empty string if the file
+// is unchanged
+func (c FileChange) Diff() string {
+	if !c.Changed() {
+		return ""
+	}
+	from, to := c.Path, c.Path
+	if !c.Exists {
+		from = "/dev/null"
+	}
+	if c.Remove {
+		to = "/dev/null"
 	}
+	diff, _ := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(c.Old),
+		B:        splitLines(c.New),
+		FromFile: from,
+		ToFile:   to,
+		Context:  3,
+	})
+	return diff
+}
 
-	cfg.SetConfig(exePath)
+// splitLines splits the content into lines for diffing, keeping the line
+// endings and marking a missing final newline like diff does
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(content, "\n")
+	if last := lines[len(lines)-1]; last == "" {
+		lines = lines[:len(lines)-1]
+	} else {
+		lines[len(lines)-1] = last + "\n\\ No newline at end of file\n"
+	}
+	return lines
+}
 
-	err = sshConfFile.Truncate(0) // Clear the file before writing
+// readFileChange starts a change to the file with its current content
+func readFileChange(fs afero.Fs, path string) (FileChange, error) {
+	c := FileChange{Path: path}
+	content, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return c, err
+	}
+	c.Old = string(content)
+	c.New = c.Old
+	c.Exists = true
+	return c, nil
+}
+
+// planSSHConfig plans the change to the SSH config file made by set
+func planSSHConfig(fs afero.Fs, sshConfPath string, set func(cfg *internal.SSHConfig) error) (FileChange, error) {
+	c, err := readFileChange(fs, sshConfPath)
 	if err != nil {
-		return fmt.Errorf("Error truncating ssh config file: %w", err)
+		return c, fmt.Errorf("Error opening ssh config file: %w", err)
 	}
-	sshConfFile.Seek(0, 0) // Reset the file pointer to the beginning
-	_, err = sshConfFile.WriteString(cfg.String())
+	cfg, err := internal.NewSSHConfigFromFile(strings.NewReader(c.Old))
 	if err != nil {
-		return fmt.Errorf("Error writing to ssh config file: %w", err)
+		return c, fmt.Errorf("Error reading ssh config file: %w", err)
+	}
+	if err := set(cfg); err != nil {
+		return c, err
 	}
+	c.New = cfg.String()
+	c.Warnings = cfg.Conflicts()
+	return c, nil
+}
 
-	return nil
+// planIncludeFile plans writing the config made by set to the include file
+func planIncludeFile(fs afero.Fs, includePath string, set func(cfg *internal.SSHConfig)) (FileChange, error) {
+	c, err := readFileChange(fs, includePath)
+	if err != nil {
+		return c, fmt.Errorf("Error reading include file: %w", err)
+	}
+	stanza := &internal.SSHConfig{}
+	set(stanza)
+	c.New = strings.TrimLeft(stanza.Config, "\n")
+	return c, nil
 }
 
-// CleanSSHConfig cleans up the SSH configuration by removing the include line and the include file
-func CleanSSHConfig(fs afero.Fs, sshConfPath string) error {
-	// If the file doesn't exist, there's nothing to clean
-	exists, err := afero.Exists(fs, sshConfPath)
+// planRemove plans removing the file if remove is set. Otherwise the file is
+// left as it is, but is still backed up with the other changes. A file that
+// doesn't exist stays that way.
+func planRemove(fs afero.Fs, path string, remove bool) (FileChange, error) {
+	c, err := readFileChange(fs, path)
 	if err != nil {
-		return fmt.Errorf("Error checking if ssh config file exists: %w", err)
+		return c, fmt.Errorf("Error reading %s: %w", path, err)
 	}
-	if !exists {
-		return nil
+	if remove || !c.Exists {
+		c.New = ""
+		c.Remove = true
 	}
+	return c, nil
+}
 
-	// Read the file content
-	sshConfFile, err := fs.OpenFile(sshConfPath, os.O_RDWR, 0600)
-	if err != nil {
-		return fmt.Errorf("Error opening ssh config file: %w", err)
+// PlanConfigure returns the changes configure makes, in the order they must
+// be applied. The include file is written before the SSH config includes it
+// and only removed after the Include line is.
+func PlanConfigure(fs afero.Fs, opts ConfigureOptions) ([]FileChange, error) {
+	var changes []FileChange
+	if opts.Clean {
+		exists, err := afero.Exists(fs, opts.SSHConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking if ssh config file exists: %w", err)
+		}
+		// If the file doesn't exist, there's nothing to clean
+		included := false
+		if exists {
+			c, err := planSSHConfig(fs, opts.SSHConfig, func(cfg *internal.SSHConfig) error {
+				cfg.Config = ""
+				if opts.IncludeFile != "" {
+					included = cfg.HasInclude(opts.IncludeFile)
+					cfg.RemoveInclude(opts.IncludeFile)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, c)
+		}
+		// Only remove the include file if it's ours, a file at the same
+		// path that the config doesn't include is left alone
+		if opts.IncludeFile != "" {
+			c, err := planRemove(fs, opts.IncludeFile, included)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, c)
+		}
+		return changes, nil
 	}
-	defer sshConfFile.Close()
 
-	cfg, err := internal.NewSSHConfigFromFile(sshConfFile)
-	if err != nil {
-		return fmt.Errorf("Error reading ssh config file: %w", err)
+	set := func(cfg *internal.SSHConfig) { cfg.SetConfig(opts.Command) }
+	if opts.KnownHostsFile != "" {
+		set = func(cfg *internal.SSHConfig) { cfg.SetStaticConfig(opts.KnownHostsFile) }
 	}
 
-	cfg.Config = "" // Clear the config part
+	if opts.Include {
+		include, err := planIncludeFile(fs, opts.IncludeFile, set)
+		if err != nil {
+			return nil, err
+		}
+		sshConfig, err := planSSHConfig(fs, opts.SSHConfig, func(cfg *internal.SSHConfig) error {
+			cfg.Config = ""
+			cfg.SetInclude(opts.IncludeFile)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []FileChange{include, sshConfig}, nil
+	}
 
-	// Write the cleaned config back to the file
-	err = sshConfFile.Truncate(0) // Clear the file before writing
+	// Switching from an include file to an inline block removes the include
+	// so the config isn't applied twice
+	included := false
+	sshConfig, err := planSSHConfig(fs, opts.SSHConfig, func(cfg *internal.SSHConfig) error {
+		set(cfg)
+		if opts.IncludeFile != "" {
+			included = cfg.HasInclude(opts.IncludeFile)
+			cfg.RemoveInclude(opts.IncludeFile)
+		}
+		return cfg.Place(opts.Placement)
+	})
 	if err != nil {
-		return fmt.Errorf("Error truncating ssh config file: %w", err)
+		return nil, err
 	}
-	sshConfFile.Seek(0, 0) // Reset the file pointer to the beginning
-	_, err = sshConfFile.WriteString(cfg.String())
-	if err != nil {
-		return fmt.Errorf("Error writing to ssh config file: %w", err)
+	changes = append(changes, sshConfig)
+	if opts.IncludeFile != "" {
+		c, err := planRemove(fs, opts.IncludeFile, included)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
 	}
+	return changes, nil
+}
 
+// ApplyChanges writes the planned changes, skipping files that are
+// unchanged. If anything changes, all the files are backed up together first,
+// keeping up to backups sets, so --restore puts them back as they were. Each
+// file is replaced atomically.
+func ApplyChanges(fs afero.Fs, changes []FileChange, backups int) error {
+	if !slices.ContainsFunc(changes, FileChange.Changed) {
+		return nil
+	}
+	paths := make([]string, len(changes))
+	for i, c := range changes {
+		paths[i] = c.Path
+	}
+	if err := internal.BackupFiles(fs, paths, backups); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if !c.Changed() {
+			continue
+		}
+		if c.Remove {
+			if err := internal.RemoveConfigFile(fs, c.Path, 0); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := internal.WriteConfigFile(fs, c.Path, []byte(c.New), 0); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// AddTailshaleConfig adds the tailshale config block to the SSH config file
+func AddTailshaleConfig(fs afero.Fs, sshConfPath, exePath string) error {
+	return configure(fs, ConfigureOptions{SSHConfig: sshConfPath, Command: exePath})
+}
+
+// AddTailshaleStaticConfig adds config to the SSH config file that uses the
+// known_hosts file written by the sync command
+func AddTailshaleStaticConfig(fs afero.Fs, sshConfPath, knownHostsPath string) error {
+	return configure(fs, ConfigureOptions{SSHConfig: sshConfPath, KnownHostsFile: knownHostsPath})
+}
+
+// AddTailshaleInclude writes the tailshale config to its own file and adds an
+// Include line for it to the top of the SSH config file, replacing any inline
+// config block
+func AddTailshaleInclude(fs afero.Fs, sshConfPath, includePath, exePath string) error {
+	return configure(fs, ConfigureOptions{SSHConfig: sshConfPath, IncludeFile: includePath, Include: true, Command: exePath})
+}
+
+// CleanSSHConfig cleans up the SSH configuration by removing the config
+// block, the include line and the include file. includePath may be empty if
+// no include file is used.
+func CleanSSHConfig(fs afero.Fs, sshConfPath, includePath string) error {
+	return configure(fs, ConfigureOptions{SSHConfig: sshConfPath, IncludeFile: includePath, Clean: true})
+}
+
+// configure plans and applies the changes for the options, holding the lock
+// on the SSH config file
+func configure(fs afero.Fs, opts ConfigureOptions) error {
+	unlock, err := internal.LockConfigFile(fs, opts.SSHConfig)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	changes, err := PlanConfigure(fs, opts)
+	if err != nil {
+		return err
+	}
+	return ApplyChanges(fs, changes, opts.Backups)
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/evilhamsterman/tailshale/internal"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestAddTailshaeConfig(t *testing.T) {
@@ -52,6 +53,20 @@ func TestAddTailshaeConfig(t *testing.T) {
 	})
 }
 
+func TestAddTailshaleStaticConfig(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, sshConfPath, []byte("existing\ncontent"), 0644)
+
+	err := AddTailshaleStaticConfig(fs, sshConfPath, "~/.ssh/known_hosts.tailscale")
+	assert.NoError(t, err)
+
+	content, _ := afero.ReadFile(fs, sshConfPath)
+	assert.Contains(t, string(content), "existing\ncontent")
+	assert.Contains(t, string(content), "UserKnownHostsFile ~/.ssh/known_hosts ~/.ssh/known_hosts2 ~/.ssh/known_hosts.tailscale")
+	assert.NotContains(t, string(content), "KnownHostsCommand")
+}
+
 func TestCleanSSHConfig(t *testing.T) {
 	sshConfPath := "/tmp/ssh_config"
 	fs := afero.NewMemMapFs()
@@ -63,7 +78,7 @@ func TestCleanSSHConfig(t *testing.T) {
 	t.Run("Remove Config", func(t *testing.T) {
 		afero.WriteFile(fs, sshConfPath, []byte(cfg.String()), 0644)
 
-		err := CleanSSHConfig(fs, sshConfPath)
+		err := CleanSSHConfig(fs, sshConfPath, "")
 		assert.NoError(t, err, "Error cleaning SSH config")
 
 		ok, _ := afero.Exists(fs, sshConfPath)
@@ -75,8 +90,218 @@ func TestCleanSSHConfig(t *testing.T) {
 	})
 
 	t.Run("File Does Not Exist", func(t *testing.T) {
-		err := CleanSSHConfig(fs, "/non/existent/path")
+		err := CleanSSHConfig(fs, "/non/existent/path", "")
 		assert.NoError(t, err, "Error should be nil when cleaning non-existent file")
 	})
 
+	t.Run("Remove Include", func(t *testing.T) {
+		includePath := "/tmp/config.d/tailshale.conf"
+		afero.WriteFile(fs, includePath, []byte(cfg.Config), 0600)
+		afero.WriteFile(fs, sshConfPath, []byte("Include "+includePath+"\n"+cfg.Beginning), 0644)
+
+		err := CleanSSHConfig(fs, sshConfPath, includePath)
+		assert.NoError(t, err)
+
+		ok, _ := afero.Exists(fs, includePath)
+		assert.False(t, ok, "Include file should be removed")
+		content, _ := afero.ReadFile(fs, sshConfPath)
+		assert.NotContains(t, string(content), "Include")
+		assert.Contains(t, string(content), cfg.Beginning)
+	})
+}
+
+func TestAddTailshaleInclude(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	includePath := "/tmp/config.d/tailshale.conf"
+	stanza := internal.SSHConfig{}
+	stanza.SetConfig("tailshale")
+
+	fs := afero.NewMemMapFs()
+	existing := "Host example.com\n  User user\n"
+	afero.WriteFile(fs, sshConfPath, []byte(existing), 0644)
+
+	require.NoError(t, AddTailshaleInclude(fs, sshConfPath, includePath, "tailshale"))
+	include, err := afero.ReadFile(fs, includePath)
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimLeft(stanza.Config, "\n"), string(include))
+
+	content, _ := afero.ReadFile(fs, sshConfPath)
+	assert.True(t, strings.HasPrefix(string(content), "Include "+includePath+"\n"), "Include should be the first line")
+	assert.Contains(t, string(content), existing)
+	assert.NotContains(t, string(content), "KnownHostsCommand", "The stanza should only be in the include file")
+
+	// Running again should not add another Include line
+	require.NoError(t, AddTailshaleInclude(fs, sshConfPath, includePath, "tailshale"))
+	again, _ := afero.ReadFile(fs, sshConfPath)
+	assert.Equal(t, string(content), string(again))
+
+	t.Run("Replaces inline config", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		AddTailshaleConfig(fs, sshConfPath, "tailshale")
+		require.NoError(t, AddTailshaleInclude(fs, sshConfPath, includePath, "tailshale"))
+		content, _ := afero.ReadFile(fs, sshConfPath)
+		assert.NotContains(t, string(content), internal.CfgStart)
+		assert.Contains(t, string(content), "Include "+includePath)
+	})
+}
+
+func TestPlanConfigure(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	includePath := "/tmp/config.d/tailshale.conf"
+	opts := ConfigureOptions{SSHConfig: sshConfPath, IncludeFile: includePath, Command: "tailshale"}
+	fs := afero.NewMemMapFs()
+	existing := "Host example.com\n  User user\n"
+	afero.WriteFile(fs, sshConfPath, []byte(existing), 0644)
+
+	changes, err := PlanConfigure(fs, opts)
+	require.NoError(t, err)
+	require.Len(t, changes, 2)
+	assert.True(t, changes[0].Changed(), "Missing config should be reported")
+	assert.False(t, changes[1].Changed(), "Absent include file should not need removing")
+	content, _ := afero.ReadFile(fs, sshConfPath)
+	assert.Equal(t, existing, string(content), "Planning should not write anything")
+
+	diff := changes[0].Diff()
+	assert.Contains(t, diff, "--- "+sshConfPath)
+	assert.Contains(t, diff, "+++ "+sshConfPath)
+	assert.Contains(t, diff, "+"+internal.CfgStart)
+	assert.Empty(t, changes[1].Diff())
+
+	require.NoError(t, ApplyChanges(fs, changes, 0))
+	changes, err = PlanConfigure(fs, opts)
+	require.NoError(t, err)
+	for _, c := range changes {
+		assert.False(t, c.Changed(), "%s should be up to date", c.Path)
+	}
+
+	t.Run("Clean", func(t *testing.T) {
+		opts := opts
+		opts.Clean = true
+		changes, err := PlanConfigure(fs, opts)
+		require.NoError(t, err)
+		assert.True(t, changes[0].Changed())
+		assert.Contains(t, changes[0].Diff(), "-"+internal.CfgStart)
+	})
+
+	t.Run("New include file", func(t *testing.T) {
+		opts := opts
+		opts.Include = true
+		changes, err := PlanConfigure(fs, opts)
+		require.NoError(t, err)
+		require.Len(t, changes, 2)
+		assert.Equal(t, includePath, changes[0].Path)
+		assert.Contains(t, changes[0].Diff(), "--- /dev/null")
+		assert.Contains(t, changes[1].Diff(), "+Include "+includePath)
+	})
+
+	t.Run("Switch from include file", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		require.NoError(t, AddTailshaleInclude(fs, sshConfPath, includePath, "tailshale"))
+		require.NoError(t, configure(fs, opts))
+		content, _ := afero.ReadFile(fs, sshConfPath)
+		assert.NotContains(t, string(content), "Include")
+		assert.Contains(t, string(content), internal.CfgStart)
+		ok, _ := afero.Exists(fs, includePath)
+		assert.False(t, ok)
+	})
+
+	t.Run("Unrelated include file", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, includePath, []byte("Host mine\n  User me\n"), 0600)
+		require.NoError(t, configure(fs, opts))
+		ok, _ := afero.Exists(fs, includePath)
+		assert.True(t, ok, "A file the config doesn't include should be kept")
+
+		clean := opts
+		clean.Clean = true
+		require.NoError(t, configure(fs, clean))
+		ok, _ = afero.Exists(fs, includePath)
+		assert.True(t, ok, "Clean should keep a file the config doesn't include")
+	})
+}
+
+func TestConfigureRestore(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	includePath := "/tmp/config.d/tailshale.conf"
+	opts := ConfigureOptions{SSHConfig: sshConfPath, IncludeFile: includePath, Command: "tailshale", Backups: 5}
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, sshConfPath, []byte("Host example.com\n  User user\n"), 0644)
+	require.NoError(t, configure(fs, opts))
+
+	// Switch to an include file, then change only the include file
+	opts.Include = true
+	require.NoError(t, configure(fs, opts))
+	config, _ := afero.ReadFile(fs, sshConfPath)
+	include, _ := afero.ReadFile(fs, includePath)
+	opts.Command = "/usr/local/bin/tailshale"
+	require.NoError(t, configure(fs, opts))
+
+	restored, err := internal.RestoreConfigFiles(fs, []string{sshConfPath, includePath}, opts.Backups)
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	content, _ := afero.ReadFile(fs, sshConfPath)
+	assert.Equal(t, string(config), string(content), "The SSH config should still include the file")
+	content, _ = afero.ReadFile(fs, includePath)
+	assert.Equal(t, string(include), string(content), "The include file should be from the previous run")
+}
+
+func TestFileChange_Diff(t *testing.T) {
+	c := FileChange{Path: "/tmp/ssh_config", Old: "Host x\n  User y", New: "Include a\nHost x\n  User y\n", Exists: true}
+	assert.Equal(t, strings.Join([]string{
+		"--- /tmp/ssh_config",
+		"+++ /tmp/ssh_config",
+		"@@ -1,2 +1,3 @@",
+		"+Include a",
+		" Host x",
+		"-  User y",
+		`\ No newline at end of file`,
+		"+  User y",
+		"",
+	}, "\n"), c.Diff())
+
+	removed := FileChange{Path: "/tmp/inc.conf", Old: "a\n", Exists: true, Remove: true}
+	assert.Equal(t, "--- /tmp/inc.conf\n+++ /dev/null\n@@ -1 +0,0 @@\n-a\n", removed.Diff())
+
+	assert.False(t, FileChange{Path: "/tmp/inc.conf", Remove: true}.Changed())
+}
+
+func TestConfigureMalformed(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	fs := afero.NewMemMapFs()
+	existing := "Host a\n" + internal.CfgStart + "\nold config\nHost b\n  User b\n"
+	afero.WriteFile(fs, sshConfPath, []byte(existing), 0644)
+
+	err := AddTailshaleConfig(fs, sshConfPath, "tailshale")
+	require.ErrorIs(t, err, internal.ErrMalformedConfig)
+	err = CleanSSHConfig(fs, sshConfPath, "")
+	require.ErrorIs(t, err, internal.ErrMalformedConfig)
+
+	content, _ := afero.ReadFile(fs, sshConfPath)
+	assert.Equal(t, existing, string(content), "A malformed config should not be written")
+}
+
+func TestPlanConfigurePlacement(t *testing.T) {
+	sshConfPath := "/tmp/ssh_config"
+	fs := afero.NewMemMapFs()
+	existing := "Host *\n  UserKnownHostsFile ~/.ssh/known_hosts\n"
+	afero.WriteFile(fs, sshConfPath, []byte(existing), 0644)
+	opts := ConfigureOptions{SSHConfig: sshConfPath, Command: "tailshale"}
+
+	changes, err := PlanConfigure(fs, opts)
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.True(t, strings.HasPrefix(changes[0].New, existing), "A new block should be added at the bottom")
+	assert.Equal(t, []string{
+		"line 2: UserKnownHostsFile is set in the Host * section before the tailshale config and takes precedence for tailnet hosts",
+	}, changes[0].Warnings)
+
+	opts.Placement = internal.Placement{Position: internal.PositionBefore, Section: "Host *"}
+	changes, err = PlanConfigure(fs, opts)
+	require.NoError(t, err)
+	assert.True(t, strings.HasSuffix(changes[0].New, internal.CfgEnd+"\n"+existing), "The block should be moved before Host *")
+	assert.Empty(t, changes[0].Warnings)
+
+	opts.Placement.Section = "Host missing"
+	_, err = PlanConfigure(fs, opts)
+	assert.ErrorContains(t, err, `section "Host missing" not found`)
 }
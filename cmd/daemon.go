@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/evilhamsterman/tailshale/daemon"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"tailscale.com/client/local"
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Serve host key lookups from a long running process",
+	Long: strings.TrimLeft(`
+Run in the background, watching the Tailscale netmap for changes and keeping
+an index of the SSH host keys in memory. The known-hosts command uses the
+daemon socket when the daemon is running and falls back to querying
+tailscaled directly when it is not.`, "\n"),
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		lc := &local.Client{}
+		c, err := newTSClient()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
+		d := daemon.New(c, lc)
+
+		socketPath := viper.GetString("daemon.socket")
+		l, err := daemon.Listen(socketPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error listening on daemon socket:", err)
+			os.Exit(1)
+		}
+		defer os.Remove(socketPath) //nolint:errcheck
+		d.Logf("listening on %s", socketPath)
+
+		go func() {
+			if err := d.Run(ctx); err != nil {
+				d.Logf("watching netmap: %v", err)
+			}
+		}()
+		if err := d.Serve(ctx, l); err != nil {
+			fmt.Fprintln(os.Stderr, "Error serving daemon socket:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	daemonCmd.Flags().String("socket", "", "Path to the daemon socket")
+	viper.BindPFlag("daemon.socket", daemonCmd.Flags().Lookup("socket")) //nolint:errcheck
+	rootCmd.AddCommand(daemonCmd)
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+var randomart bool
+
+var fingerprintCmd = &cobra.Command{
+	Use:   "fingerprint <host>...",
+	Short: "Print SSH host key fingerprints for Tailscale nodes",
+	Long: strings.TrimLeft(`
+Print the SHA256 and legacy MD5 fingerprints of the SSH host keys for each
+Tailscale node, in the same format as ssh-keygen -l. With --randomart the
+OpenSSH visual host key is printed after each key.`, "\n"),
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newTSClient()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
+		failed := false
+		for _, host := range args {
+			tsHost, err := c.GetHost(context.Background(), host)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error looking up %s: %v\n", host, err)
+				failed = true
+				continue
+			}
+			for _, line := range FingerprintLines(tsHost, randomart) {
+				fmt.Println(line)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(fingerprintCmd)
+	fingerprintCmd.Flags().BoolVar(&randomart, "randomart", false, "Print the randomart visual host key for each key")
+}
+
+// FingerprintLines returns the SHA256 and MD5 fingerprint lines for each of
+// the host's keys, followed by the randomart if requested.
+func FingerprintLines(tsHost *ts.TailscaleHost, randomart bool) []string {
+	name := strings.TrimSuffix(tsHost.Name, ".")
+	lines := []string{}
+	for _, key := range tsHost.Keys {
+		bits := internal.KeyBits(key)
+		typeName := internal.KeyTypeName(key)
+		lines = append(lines,
+			fmt.Sprintf("%d %s %s (%s)", bits, ssh.FingerprintSHA256(key), name, typeName),
+			fmt.Sprintf("%d %s %s (%s)", bits, internal.FingerprintMD5(key), name, typeName),
+		)
+		if randomart {
+			lines = append(lines, internal.Randomart(key))
+		}
+	}
+	return lines
+}
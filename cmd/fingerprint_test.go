@@ -0,0 +1,21 @@
+package cmd
+
+import (
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFingerprintLines(t *testing.T) {
+	lines := FingerprintLines(h, false)
+	assert.Equal(t, []string{
+		"256 SHA256:bx2Qwm9lbwHelSx7kG0/JwVfuruOIMiK87dRn0F4NeQ test.example.ts.net (ED25519)",
+		"256 MD5:48:0d:cf:76:3d:8d:01:85:70:c4:d8:68:94:a5:bb:4d test.example.ts.net (ED25519)",
+	}, lines)
+
+	lines = FingerprintLines(h, true)
+	require.Len(t, lines, 3)
+	assert.Equal(t, in.Randomart(in.TEST_HOST_KEY_OBJECT), lines[2])
+}
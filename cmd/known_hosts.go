@@ -1,25 +1,52 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 
+	"github.com/evilhamsterman/tailshale/cache"
+	"github.com/evilhamsterman/tailshale/daemon"
+	"github.com/evilhamsterman/tailshale/internal"
+	"github.com/evilhamsterman/tailshale/pin"
+	"github.com/evilhamsterman/tailshale/policy"
 	ts "github.com/evilhamsterman/tailshale/tailscale"
 	"github.com/miekg/dns"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
-	"golang.org/x/crypto/ssh/knownhosts"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/local"
 )
 
 var (
 	check        bool
+	all          bool
+	noCache      bool
+	outputFormat string
+	sshfpTTL     uint32
+	sshfpOrigin  string
+	peerFilter   ts.PeerFilter
+	trustPolicy  *policy.Policy
+	keyPins      *pin.Guard
 	HostKeyTypes struct {
 		rsa     bool
 		ecdsa   bool
 		ed25519 bool
 	}
+	// KeySelection holds the values passed by the ssh KnownHostsCommand tokens
+	KeySelection struct {
+		port       int
+		keyType    string
+		key        string
+		algorithms []string
+	}
 )
 
 var knownHostsCmd = &cobra.Command{
@@ -28,16 +55,74 @@ var knownHostsCmd = &cobra.Command{
 	Long: strings.TrimLeft(`
 This command retrieves and prints the SSH host keys for Tailscale nodes that
 have Tailscale SSH enabled. It prints them out in a format compatible with the
-SSH known_hosts file.`, "\n"),
-	Args: cobra.MinimumNArgs(1),
+SSH known_hosts file.
+
+With --all every SSH enabled peer in the tailnet is printed, optionally
+filtered by tag, OS and online state.
+
+Hosts may be given as [host]:port, as passed by the ssh %H token. When ssh
+passes the key type (%t) only keys of that type are printed. The key offered
+by the server (%K) never limits the output, so ssh still reports a changed
+host key when it doesn't match. Use --check with --key to only validate the
+offered key.
+
+Cert authorities from the policy are printed as @cert-authority lines, and
+revoked keys as @revoked lines instead of being trusted. With --hash the
+host names and addresses of @cert-authority lines are hashed too, but
+wildcard patterns such as the *.<tailnet> used with --all can't be hashed and
+are printed as is.
+
+With --output json or yaml a record is printed for each host, including its
+addresses, tags, owner, key fingerprints and any lookup error. With --output
+sshfp the keys are printed as SSHFP DNS records, and --output zone wraps them
+in a zone file fragment. The records are named after the tailnet FQDN of each
+host, or <host>.<origin> with --origin for a zone outside the tailnet.`, "\n"),
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := validateOutput(outputFormat); err != nil {
+			return err
+		}
+		if _, ok := dns.IsDomainName(sshfpOrigin); sshfpOrigin != "" && !ok {
+			return fmt.Errorf("invalid origin %q", sshfpOrigin)
+		}
+		if all {
+			if check {
+				return fmt.Errorf("--check cannot be used with --all")
+			}
+			return cobra.NoArgs(cmd, args)
+		}
+		return cobra.MinimumNArgs(1)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
-		c, _ := ts.NewTSClient(&local.Client{})
+		var err error
+		if trustPolicy, err = loadPolicy(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading policy:", err)
+			os.Exit(1)
+		}
+		if keyPins, err = loadPinGuard(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading pin configuration:", err)
+			os.Exit(1)
+		}
+		if all {
+			c, err := newTSClient()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+				os.Exit(1)
+			}
+			PrintAllKnownHosts(peerFilter, c)
+			return
+		}
+		c, err := newHostGetter()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
 		if check && len(args) > 1 {
 			cmd.PrintErrln("Error: --check can only be used with a single host")
 			return
 		} else if check {
 			// Check if the host supports Tailscale SSH
-			if !CheckHost(args[0], c) {
+			host, _ := splitHostPort(args[0])
+			if !CheckHost(host, c) {
 				fmt.Fprintf(os.Stderr, "Host %s does not support Tailscale SSH.\n", args[0])
 				os.Exit(1)
 			}
@@ -51,27 +136,309 @@ func init() {
 	rootCmd.AddCommand(knownHostsCmd)
 	knownHostsCmd.Flags().SortFlags = false
 	knownHostsCmd.Flags().BoolVar(&check, "check", false, "Check if the host supports Tailscale SSH")
+	knownHostsCmd.Flags().BoolVar(&all, "all", false, "Print host keys for every SSH enabled peer in the tailnet")
+	knownHostsCmd.Flags().StringSliceVar(&peerFilter.Tags, "tag", nil, "Only include peers with one of these tags (with --all)")
+	knownHostsCmd.Flags().StringVar(&peerFilter.OS, "os", "", "Only include peers running this OS (with --all)")
+	knownHostsCmd.Flags().BoolVar(&peerFilter.Online, "online", false, "Only include peers that are online (with --all)")
+	knownHostsCmd.Flags().BoolVar(&noCache, "no-cache", false, "Do not use the host key cache")
+	knownHostsCmd.Flags().StringVarP(&outputFormat, "output", "o", OutputKnownHosts, "Output format: known_hosts, json, yaml, sshfp or zone")
+	knownHostsCmd.Flags().Uint32Var(&sshfpTTL, "ttl", 3600, "TTL of the records for sshfp and zone output")
+	knownHostsCmd.Flags().StringVar(&sshfpOrigin, "origin", "", "Zone to name sshfp and zone records in, as <host>.<origin>")
+	knownHostsCmd.Flags().IntVar(&KeySelection.port, "port", 22, "Port the host is connected on (ssh %p)")
+	knownHostsCmd.Flags().StringVar(&KeySelection.keyType, "key-type", "", "Only print keys of this type (ssh %t)")
+	knownHostsCmd.Flags().StringVar(&KeySelection.key, "key", "", "Base64 encoded key offered by the server (ssh %K), with --check only succeed if the host advertises it")
+	knownHostsCmd.Flags().StringSliceVar(&KeySelection.algorithms, "host-key-algorithms", defaultAlgorithms, "Order to print keys in")
+	knownHostsCmd.Flags().Bool("hash", false, "Hash hostnames like ssh-keygen -H")
+	viper.BindPFlag("known_hosts.hash", knownHostsCmd.Flags().Lookup("hash")) //nolint:errcheck
 	knownHostsCmd.Flags().BoolVar(&HostKeyTypes.rsa, "rsa", true, "Include RSA host keys")
 	knownHostsCmd.Flags().BoolVar(&HostKeyTypes.ecdsa, "ecdsa", true, "Include ECDSA host keys")
 	knownHostsCmd.Flags().BoolVar(&HostKeyTypes.ed25519, "ed25519", true, "Include Ed25519 host keys")
 }
 
-// getHostNames generates the hostnames and IP addresses for the given Tailscale node
-func getHostNames(host *ts.TailscaleHost) []string {
+// clientModes returns the configured resolver and Tailnet Lock mode,
+// rejecting unknown values rather than treating them as auto
+func clientModes() (ts.ResolveMode, ts.LockMode, error) {
+	resolver := ts.ResolveMode(viper.GetString("resolver"))
+	if !slices.Contains([]ts.ResolveMode{ts.ResolveAuto, ts.ResolveDNS, ts.ResolveNetmap}, resolver) {
+		return "", "", fmt.Errorf("invalid resolver %q", resolver)
+	}
+	lockMode := ts.LockMode(viper.GetString("tailnet_lock"))
+	if !slices.Contains([]ts.LockMode{ts.LockOff, ts.LockAuto, ts.LockRequire}, lockMode) {
+		return "", "", fmt.Errorf("invalid tailnet_lock mode %q", lockMode)
+	}
+	return resolver, lockMode, nil
+}
+
+// newTSClient connects to the local tailscaled using the configured resolver
+func newTSClient() (*ts.TSClient, error) {
+	resolver, lockMode, err := clientModes()
+	if err != nil {
+		return nil, err
+	}
+	c, err := ts.NewTSClient(&local.Client{})
+	if err != nil {
+		return nil, err
+	}
+	c.Resolver = resolver
+	c.TailnetLock = lockMode
+	return c, nil
+}
+
+// newHostGetter returns the client used to look up hosts. The daemon is used
+// when it is running, otherwise when the cache is enabled tailscaled is only
+// contacted on a cache miss.
+func newHostGetter() (ts.HostGetter, error) {
+	// Check the configuration now, a cache hit would otherwise hide a typo
+	if _, _, err := clientModes(); err != nil {
+		return nil, err
+	}
+	connect := func() (ts.HostGetter, error) {
+		return newTSClient()
+	}
+	direct := connect
+	if cachePath := viper.GetString("cache.path"); !noCache && viper.GetBool("cache.enabled") && cachePath != "" {
+		direct = func() (ts.HostGetter, error) {
+			c := cache.New(afero.NewOsFs(), cachePath, viper.GetDuration("cache.ttl"))
+			return cache.NewClient(c, connect), nil
+		}
+	}
+	if socketPath := viper.GetString("daemon.socket"); socketPath != "" {
+		if c, err := daemon.Dial(socketPath); err == nil {
+			// Hosts the daemon hasn't indexed are looked up directly
+			c.Fallback = direct
+			return c, nil
+		}
+	}
+	return direct()
+}
+
+// defaultAlgorithms is the default host key preference order of OpenSSH
+var defaultAlgorithms = []string{ts.ED25519, ts.ECDSA, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ts.RSA}
+
+// splitHostPort splits a host given as [host]:port, as passed by the ssh %H
+// token. The port is 0 if not present.
+func splitHostPort(arg string) (string, int) {
+	if !strings.HasPrefix(arg, "[") {
+		return arg, 0
+	}
+	host, portStr, err := net.SplitHostPort(arg)
+	if err != nil {
+		return strings.Trim(arg, "[]"), 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
+
+// hostPatterns formats the hostnames as known_hosts patterns for the given
+// port. Hosts on non-default ports are written as [host]:port.
+func hostPatterns(hostnames []string, port int) []string {
+	if port == 0 || port == 22 {
+		return hostnames
+	}
+	patterns := make([]string, 0, len(hostnames))
+	for _, h := range hostnames {
+		patterns = append(patterns, fmt.Sprintf("[%s]:%d", h, port))
+	}
+	return patterns
+}
+
+// keyTypeForAlgorithm returns the key type used by a host key algorithm
+func keyTypeForAlgorithm(algo string) string {
+	switch algo {
+	case ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSASHA512:
+		return ts.RSA
+	}
+	return algo
+}
+
+// keyTypeEnabled reports whether the key type was enabled with the key type
+// flags.
+func keyTypeEnabled(keyType string) bool {
+	switch keyType {
+	case ts.RSA:
+		return HostKeyTypes.rsa
+	case ts.ECDSA:
+		return HostKeyTypes.ecdsa
+	case ts.ED25519:
+		return HostKeyTypes.ed25519
+	}
+	return false
+}
+
+// offeredKey returns the key offered by the server as passed by ssh, or nil
+// if it isn't set
+func offeredKey() ssh.PublicKey {
+	if KeySelection.key == "" || KeySelection.key == "NONE" {
+		return nil
+	}
+	var offered ssh.PublicKey
+	if data, err := base64.StdEncoding.DecodeString(KeySelection.key); err == nil {
+		offered, _ = ssh.ParsePublicKey(data)
+	}
+	if offered == nil {
+		fmt.Fprintln(os.Stderr, "Ignoring invalid offered host key")
+	}
+	return offered
+}
+
+// selectKeys returns the host keys to print in the configured algorithm order,
+// limited to the key type negotiated by ssh if set. The offered key doesn't
+// limit them: if it matches none of them ssh has to see the advertised keys
+// to report the host key as changed, rather than treating the host as new.
+func selectKeys(tsHost *ts.TailscaleHost) []ssh.PublicKey {
+	wantType := ""
+	if KeySelection.keyType != "NONE" {
+		wantType = keyTypeForAlgorithm(KeySelection.keyType)
+	}
+
+	// Order by the algorithm preference, then any remaining key types by name
+	order := []string{}
+	for _, algo := range KeySelection.algorithms {
+		if t := keyTypeForAlgorithm(algo); !slices.Contains(order, t) {
+			order = append(order, t)
+		}
+	}
+	for _, t := range tsHost.KeyTypes() {
+		if !slices.Contains(order, t) {
+			order = append(order, t)
+		}
+	}
+
+	var keys []ssh.PublicKey
+	for _, keyType := range order {
+		if !keyTypeEnabled(keyType) || (wantType != "" && keyType != wantType) {
+			continue
+		}
+		for _, key := range tsHost.KeysOfType(keyType) {
+			if trustPolicy.IsRevoked(key) {
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// loadPolicy reads the trust policy from the configuration
+func loadPolicy() (*policy.Policy, error) {
+	p := &policy.Policy{}
+	if err := viper.UnmarshalKey("policy", p); err != nil {
+		return nil, err
+	}
+	return p, p.Validate()
+}
+
+// loadPinGuard sets up key pinning from the configuration, returning nil if
+// pinning is disabled
+func loadPinGuard() (*pin.Guard, error) {
+	if !viper.GetBool("pin.enabled") {
+		return nil, nil
+	}
+	path := viper.GetString("pin.path")
+	if path == "" {
+		return nil, fmt.Errorf("pin.path is not set")
+	}
+	mode := pin.Mode(viper.GetString("pin.mode"))
+	if !slices.Contains([]pin.Mode{pin.Fail, pin.Warn, pin.Repin}, mode) {
+		return nil, fmt.Errorf("invalid pin mode %q", mode)
+	}
+	fs := afero.NewOsFs()
+	var hooks []pin.Hook
+	if command := viper.GetString("pin.hook.command"); command != "" {
+		hooks = append(hooks, &pin.CommandHook{Command: command})
+	}
+	if log := viper.GetString("pin.hook.log"); log != "" {
+		hooks = append(hooks, &pin.LogHook{Fs: fs, Path: log})
+	}
+	if url := viper.GetString("pin.hook.webhook"); url != "" {
+		if err := pin.CheckWebhookURL(url); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, &pin.WebhookHook{URL: url})
+	}
+	return pin.NewGuard(pin.New(fs, path), mode, hooks...), nil
+}
+
+// trusted checks the host against the trust policy and its pinned keys,
+// logging why it was rejected and any warnings.
+func trusted(tsHost *ts.TailscaleHost) bool {
+	result, err := trustPolicy.Evaluate(tsHost)
+	for _, warning := range result.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if err := keyPins.Check(context.Background(), tsHost); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// shortName returns the first label of the host's name
+func shortName(host *ts.TailscaleHost) string {
+	return dns.SplitDomainName(dns.CanonicalName(host.Name))[0]
+}
+
+// shortNameOwners returns the host each short name resolves to, with the
+// same precedence as the netmap lookup and the daemon index: a node in this
+// tailnet wins over one shared in from another, and a name claimed by more
+// than one node of the same kind resolves to none. OpenSSH accepts any
+// matching line, so listing an ambiguous name would let either node's key be
+// trusted for it.
+func shortNameOwners(hosts []*ts.TailscaleHost) map[string]*ts.TailscaleHost {
+	owners := map[string]*ts.TailscaleHost{}
+	ambiguous := map[string]bool{}
+	for _, host := range hosts {
+		short := strings.ToLower(shortName(host))
+		prev, ok := owners[short]
+		switch {
+		case !ok, prev.Shared && !host.Shared:
+			owners[short] = host
+			delete(ambiguous, short)
+		case prev.Shared == host.Shared:
+			ambiguous[short] = true
+		}
+	}
+	for short := range ambiguous {
+		delete(owners, short)
+	}
+	return owners
+}
+
+// getHostNames generates the hostnames and IP addresses for the given
+// Tailscale node. The short name is only included if it resolves to the node
+// in owners.
+func getHostNames(host *ts.TailscaleHost, owners map[string]*ts.TailscaleHost) []string {
 	cn := dns.CanonicalName(host.Name)
 	fqdn := strings.TrimSuffix(cn, ".")
-	hostname := dns.SplitDomainName(fqdn)[0]
+	hostname := shortName(host)
 
-	return []string{
-		host.IP.String(),
-		cn,
-		fqdn,
-		hostname,
+	hostnames := make([]string, 0, len(host.IPs)+3)
+	for _, ip := range host.IPs {
+		hostnames = append(hostnames, ip.String())
+	}
+	hostnames = append(hostnames, cn, fqdn)
+	if owners[strings.ToLower(hostname)] != host {
+		return hostnames
 	}
+	return append(hostnames, hostname)
+}
+
+// knownHostsLine returns a known_hosts line for the given hostnames. Unlike
+// knownhosts.Line it leaves IPv6 addresses unbracketed, which is how OpenSSH
+// records hosts on the default port.
+func knownHostsLine(hostnames []string, key ssh.PublicKey) string {
+	return strings.Join(hostnames, ",") + " " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
 }
 
 // CheckHost checks if the given host supports Tailscale SSH
-func CheckHost(host string, tsclient *ts.TSClient) bool {
+func CheckHost(host string, tsclient ts.HostGetter) bool {
 	tsHost, err := tsclient.GetHost(context.Background(), host)
 	if err != nil {
 		return false
@@ -79,45 +446,227 @@ func CheckHost(host string, tsclient *ts.TSClient) bool {
 	if tsHost == nil {
 		return false
 	}
-	if len(tsHost.Keys) == 0 {
+	// With an offered key only that key is validated
+	offered := offeredKey()
+	if !slices.ContainsFunc(tsHost.Keys, func(key ssh.PublicKey) bool {
+		if offered != nil && !bytes.Equal(offered.Marshal(), key.Marshal()) {
+			return false
+		}
+		return !trustPolicy.IsRevoked(key)
+	}) {
 		return false
 	}
-	return true
+	return trusted(tsHost)
+}
+
+// knownHostsLines generates the known_hosts lines for the selected keys of the
+// given Tailscale node, only including its short name if it owns it.
+func knownHostsLines(tsHost *ts.TailscaleHost, port int, owners map[string]*ts.TailscaleHost) []string {
+	hostnames := hostPatterns(getHostNames(tsHost, owners), port)
+	var lines []string
+	for _, key := range selectKeys(tsHost) {
+		if !viper.GetBool("known_hosts.hash") {
+			lines = append(lines, knownHostsLine(hostnames, key))
+			continue
+		}
+		// Hashed hostnames can't be combined, so each gets its own line
+		for _, hostname := range hostnames {
+			lines = append(lines, knownHostsLine([]string{internal.HashHostname(hostname, key)}, key))
+		}
+	}
+	return lines
+}
+
+// printKnownHostsLines prints the known_hosts lines, exiting with an error if
+// there are none.
+func printKnownHostsLines(known_hosts []string) {
+	if len(known_hosts) == 0 {
+		fmt.Fprintln(os.Stderr, "No Tailscale SSH host keys found.")
+		os.Exit(1)
+	}
+
+	for _, line := range known_hosts {
+		fmt.Println(line)
+	}
 }
 
 // PrintKnownHosts prints the SSH host keys for the given Tailscale nodes.
-func PrintKnownHosts(nodes []string, tsclient *ts.TSClient) {
+func PrintKnownHosts(nodes []string, tsclient ts.HostGetter) {
+	switch outputFormat {
+	case OutputJSON, OutputYAML:
+		printHostRecords(lookupHostRecords(nodes, tsclient))
+		return
+	case OutputSSHFP, OutputZone:
+		printKnownHostsLines(sshfpLines(lookupTrustedHosts(nodes, tsclient), outputFormat == OutputZone))
+		return
+	}
+	printKnownHostsLines(lookupKnownHostsLines(nodes, tsclient))
+}
 
-	known_hosts := []string{}
+// lookupKnownHostsLines looks up each node and returns the known_hosts lines
+// for the trusted ones, skipping any that fail or have no SSH host keys.
+func lookupKnownHostsLines(nodes []string, tsclient ts.HostGetter) []string {
+	hosts := []*ts.TailscaleHost{}
+	ports := []int{}
+	queries := []string{}
 	for _, node := range nodes {
-		tsHost, err := tsclient.GetHost(context.Background(), node)
+		host, port := splitHostPort(node)
+		if port == 0 {
+			port = KeySelection.port
+		}
+		tsHost, err := tsclient.GetHost(context.Background(), host)
 		if err != nil {
 			continue
 		}
-		if tsHost == nil || len(tsHost.Keys) == 0 {
+		if tsHost == nil || len(tsHost.Keys) == 0 || !trusted(tsHost) {
 			continue
 		}
-		hostnames := getHostNames(tsHost)
-		var l string
-		for keyType, key := range tsHost.Keys {
-			switch {
-			case keyType == ts.RSA && HostKeyTypes.rsa:
-				l = knownhosts.Line(hostnames, key)
-			case keyType == ts.ECDSA && HostKeyTypes.ecdsa:
-				l = knownhosts.Line(hostnames, key)
-			case keyType == ts.ED25519 && HostKeyTypes.ed25519:
-				l = knownhosts.Line(hostnames, key)
+		hosts = append(hosts, tsHost)
+		ports = append(ports, port)
+		queries = append(queries, host)
+	}
+
+	// Only the looked up nodes are known here. A local node always owns its
+	// short name, but a shared node only does if it was looked up by it,
+	// since the lookup would have preferred a local node with the same name.
+	owners := shortNameOwners(hosts)
+	for i, tsHost := range hosts {
+		short := strings.ToLower(shortName(tsHost))
+		if tsHost.Shared && owners[short] == tsHost && !strings.EqualFold(strings.TrimSuffix(queries[i], "."), short) {
+			delete(owners, short)
+		}
+	}
+	known_hosts := []string{}
+	caHosts := []string{}
+	for i, tsHost := range hosts {
+		if !tsHost.Shared {
+			caHosts = append(caHosts, hostPatterns(getHostNames(tsHost, owners), ports[i])...)
+		}
+		known_hosts = append(known_hosts, knownHostsLines(tsHost, ports[i], owners)...)
+	}
+	return append(markerLines(hosts, caHosts), known_hosts...)
+}
+
+// markerLines generates the @cert-authority lines for the policy's cert
+// authorities, scoped to caHosts unless they list their own patterns, and the
+// @revoked lines for revoked keys including any advertised by the hosts.
+func markerLines(hosts []*ts.TailscaleHost, caHosts []string) []string {
+	if trustPolicy == nil {
+		return nil
+	}
+	lines := []string{}
+	for _, ca := range trustPolicy.CertAuthorities {
+		key, err := ca.PublicKey()
+		if err != nil {
+			continue
+		}
+		patterns := ca.Hosts
+		if len(patterns) == 0 {
+			patterns = caHosts
+		}
+		if len(patterns) == 0 {
+			continue
+		}
+		if !viper.GetBool("known_hosts.hash") {
+			lines = append(lines, "@cert-authority "+knownHostsLine(patterns, key))
+			continue
+		}
+		// Wildcard patterns can't be hashed and are kept on one line, the
+		// rest are hashed one per line
+		var wildcards []string
+		for _, pattern := range patterns {
+			if internal.IsWildcardPattern(pattern) {
+				wildcards = append(wildcards, pattern)
+				continue
 			}
-			known_hosts = append(known_hosts, l)
+			lines = append(lines, "@cert-authority "+knownHostsLine([]string{internal.HashHostname(pattern, key)}, key))
+		}
+		if len(wildcards) > 0 {
+			lines = append(lines, "@cert-authority "+knownHostsLine(wildcards, key))
 		}
 	}
 
-	if len(known_hosts) == 0 {
-		fmt.Fprintln(os.Stderr, "No Tailscale SSH host keys found.")
-		os.Exit(1)
+	// Fingerprints can only be revoked once a host advertises the key
+	revoked := trustPolicy.RevokedKeys()
+	for _, tsHost := range hosts {
+		for _, key := range tsHost.Keys {
+			if !trustPolicy.IsRevoked(key) || slices.ContainsFunc(revoked, func(r ssh.PublicKey) bool {
+				return bytes.Equal(r.Marshal(), key.Marshal())
+			}) {
+				continue
+			}
+			revoked = append(revoked, key)
+		}
 	}
+	for _, key := range revoked {
+		lines = append(lines, "@revoked "+knownHostsLine([]string{"*"}, key))
+	}
+	return lines
+}
 
-	for _, line := range known_hosts {
-		fmt.Println(line)
+// trustedKnownHostsLines generates the known_hosts lines for every host
+// trusted by the policy, after the marker lines for the tailnet.
+func trustedKnownHostsLines(hosts []*ts.TailscaleHost, tailnet string) []string {
+	trustedHosts := []*ts.TailscaleHost{}
+	for _, tsHost := range hosts {
+		if trusted(tsHost) {
+			trustedHosts = append(trustedHosts, tsHost)
+		}
 	}
+	// Short names resolve across every node, trusted or not, so a rejected
+	// local node still hides a shared node's short name
+	owners := shortNameOwners(hosts)
+	known_hosts := []string{}
+	for _, tsHost := range trustedHosts {
+		known_hosts = append(known_hosts, knownHostsLines(tsHost, KeySelection.port, owners)...)
+	}
+	var caHosts []string
+	if tailnet != "" {
+		caHosts = []string{"*." + strings.TrimSuffix(tailnet, ".")}
+	}
+	return append(markerLines(trustedHosts, caHosts), known_hosts...)
+}
+
+// PrintAllKnownHosts prints the SSH host keys for every Tailscale node that
+// matches the filter.
+func PrintAllKnownHosts(filter ts.PeerFilter, tsclient *ts.TSClient) {
+	hosts, err := tsclient.GetAllHosts(context.Background(), filter)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error listing Tailscale peers:", err)
+		os.Exit(1)
+	}
+	records, lines, err := allHostsOutput(hosts, tsclient.Tailnet)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error updating pin store:", err)
+		os.Exit(1)
+	}
+	if records != nil {
+		printHostRecords(records)
+		return
+	}
+	printKnownHostsLines(lines)
+}
+
+// allHostsOutput returns the records or lines to print for the hosts in the
+// output format. Every host's pin is checked with one read and write of the
+// pin store, before anything is printed since printing may exit.
+func allHostsOutput(hosts []*ts.TailscaleHost, tailnet string) ([]ts.HostRecord, []string, error) {
+	var records []ts.HostRecord
+	var lines []string
+	err := keyPins.Batch(func() error {
+		switch outputFormat {
+		case OutputJSON, OutputYAML:
+			records = make([]ts.HostRecord, 0, len(hosts))
+			for _, tsHost := range hosts {
+				records = append(records, hostRecord("", tsHost))
+			}
+		case OutputSSHFP, OutputZone:
+			trustedHosts := slices.DeleteFunc(hosts, func(tsHost *ts.TailscaleHost) bool { return !trusted(tsHost) })
+			lines = sshfpLines(trustedHosts, outputFormat == OutputZone)
+		default:
+			lines = trustedKnownHostsLines(hosts, tailnet)
+		}
+		return nil
+	})
+	return records, lines, err
 }
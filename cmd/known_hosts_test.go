@@ -1,27 +1,437 @@
 package cmd
 
 import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/netip"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	in "github.com/evilhamsterman/tailshale/internal"
+	"github.com/evilhamsterman/tailshale/pin"
+	"github.com/evilhamsterman/tailshale/policy"
 	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/ssh"
 )
 
 var h = &ts.TailscaleHost{
 	Name: "test.example.ts.net",
-	IP:   in.TEST_IP,
-	Keys: map[string]ssh.PublicKey{
-		ts.ED25519: in.TEST_HOST_KEY_OBJECT,
+	IPs:  []netip.Addr{in.TEST_IP, in.TEST_IP6},
+	Keys: []ssh.PublicKey{
+		in.TEST_HOST_KEY_OBJECT,
 	},
 }
 
 func TestGetHostNames(t *testing.T) {
-	hosts := getHostNames(h)
-	assert.Len(t, hosts, 4)
+	hosts := getHostNames(h, shortNameOwners([]*ts.TailscaleHost{h}))
+	assert.Len(t, hosts, 5)
 	assert.Contains(t, hosts, "test.example.ts.net")
 	assert.Contains(t, hosts, "test.example.ts.net.")
 	assert.Contains(t, hosts, in.TEST_IP.String())
+	assert.Contains(t, hosts, in.TEST_IP6.String())
 	assert.Contains(t, hosts, "test")
 }
+
+func TestKnownHostsLines(t *testing.T) {
+	HostKeyTypes.ed25519 = true
+	lines := knownHostsLines(h, 22, shortNameOwners([]*ts.TailscaleHost{h}))
+	assert.Equal(t, []string{
+		"100.100.100.100,fd7a:115c:a1e0::1,test.example.ts.net.,test.example.ts.net,test " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(in.TEST_HOST_KEY_OBJECT))),
+	}, lines)
+
+	HostKeyTypes.ed25519 = false
+	assert.Empty(t, knownHostsLines(h, 22, shortNameOwners([]*ts.TailscaleHost{h})))
+	HostKeyTypes.ed25519 = true
+}
+
+func TestKnownHostsLines_Hash(t *testing.T) {
+	HostKeyTypes.ed25519 = true
+	defer viper.Set("known_hosts.hash", viper.Get("known_hosts.hash"))
+	viper.Set("known_hosts.hash", true)
+
+	lines := knownHostsLines(h, 22, shortNameOwners([]*ts.TailscaleHost{h}))
+	hostnames := getHostNames(h, shortNameOwners([]*ts.TailscaleHost{h}))
+	require.Len(t, lines, len(hostnames), "Each hostname should have its own line")
+	for i, line := range lines {
+		entries := in.ParseKnownHosts(line)
+		require.Len(t, entries, 1)
+		require.Len(t, entries[0].Hosts, 1)
+		assert.True(t, in.MatchHashedHost(entries[0].Hosts[0], hostnames[i]))
+		assert.NotEqual(t, hostnames[i], entries[0].Hosts[0])
+	}
+	assert.Equal(t, lines, knownHostsLines(h, 22, shortNameOwners([]*ts.TailscaleHost{h})), "Hashing should be stable so sync doesn't rewrite the file")
+
+	t.Run("Cert authorities", func(t *testing.T) {
+		defer func() { trustPolicy = nil }()
+		trustPolicy = &policy.Policy{CertAuthorities: []policy.CertAuthority{{Key: in.TEST_HOST_KEY}}}
+		lines := markerLines(nil, []string{"test.example.ts.net", "100.100.100.100", "*.corp.example.com"})
+		require.Len(t, lines, 3)
+		for i, host := range []string{"test.example.ts.net", "100.100.100.100"} {
+			entries := in.ParseKnownHosts(lines[i])
+			require.Len(t, entries[0].Hosts, 1)
+			assert.True(t, in.MatchHashedHost(entries[0].Hosts[0], host), "%s should be hashed", host)
+		}
+		assert.True(t, strings.HasPrefix(lines[2], "@cert-authority *.corp.example.com "), "Wildcards can't be hashed")
+	})
+}
+
+func TestKnownHostsLines_SharedShortName(t *testing.T) {
+	HostKeyTypes.ed25519 = true
+	key2, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_HOST_KEY_2))
+	require.NoError(t, err)
+	local := &ts.TailscaleHost{
+		Name:       "test.example.ts.net.",
+		IPs:        []netip.Addr{in.TEST_IP},
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	shared := &ts.TailscaleHost{
+		Name:       "test.other.ts.net.",
+		IPs:        []netip.Addr{netip.MustParseAddr("100.100.100.101")},
+		Keys:       []ssh.PublicKey{key2},
+		Authorized: true,
+		Shared:     true,
+	}
+
+	owners := shortNameOwners([]*ts.TailscaleHost{shared, local})
+	assert.Equal(t, local, owners["test"], "A local node should win over a shared one, as in the lookup")
+	assert.Contains(t, getHostNames(local, owners), "test")
+	assert.NotContains(t, getHostNames(shared, owners), "test")
+
+	lines := trustedKnownHostsLines([]*ts.TailscaleHost{local, shared}, "example.ts.net")
+	require.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "100.100.100.100,test.example.ts.net.,test.example.ts.net,test "), "The local node should keep its short name")
+	assert.True(t, strings.HasPrefix(lines[1], "100.100.100.101,test.other.ts.net.,test.other.ts.net "))
+
+	// A shared node is addressed by its short name if no local node has it
+	lines = trustedKnownHostsLines([]*ts.TailscaleHost{shared}, "example.ts.net")
+	require.Len(t, lines, 1)
+	assert.Contains(t, in.ParseKnownHosts(lines[0])[0].Hosts, "test", "A unique short name should be kept")
+
+	// An untrusted local node still owns the name
+	local.Authorized = false
+	defer func() { trustPolicy = nil }()
+	trustPolicy = &policy.Policy{}
+	lines = trustedKnownHostsLines([]*ts.TailscaleHost{local, shared}, "example.ts.net")
+	require.Len(t, lines, 1)
+	assert.NotContains(t, in.ParseKnownHosts(lines[0])[0].Hosts, "test")
+
+	t.Run("Lookup", func(t *testing.T) {
+		getter := getterFunc(func(ctx context.Context, name string) (*ts.TailscaleHost, error) {
+			return shared, nil
+		})
+		lines := lookupKnownHostsLines([]string{"test"}, getter)
+		require.Len(t, lines, 1)
+		assert.Contains(t, in.ParseKnownHosts(lines[0])[0].Hosts, "test", "A shared node looked up by its short name owns it")
+		lines = lookupKnownHostsLines([]string{"test.other.ts.net"}, getter)
+		require.Len(t, lines, 1)
+		assert.NotContains(t, in.ParseKnownHosts(lines[0])[0].Hosts, "test", "A local node may own the short name")
+	})
+
+	twin := *shared
+	twin.Name = "test.third.ts.net."
+	assert.Empty(t, shortNameOwners([]*ts.TailscaleHost{shared, &twin}), "Two shared nodes with the same name are ambiguous")
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		arg  string
+		host string
+		port int
+	}{
+		{"test", "test", 0},
+		{"[test]:2222", "test", 2222},
+		{"[fd7a:115c:a1e0::1]:22", "fd7a:115c:a1e0::1", 22},
+		{"fd7a:115c:a1e0::1", "fd7a:115c:a1e0::1", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			host, port := splitHostPort(tt.arg)
+			assert.Equal(t, tt.host, host)
+			assert.Equal(t, tt.port, port)
+		})
+	}
+}
+
+func TestHostPatterns(t *testing.T) {
+	assert.Equal(t, []string{"test"}, hostPatterns([]string{"test"}, 22))
+	assert.Equal(t, []string{"[test]:2222", "[fd7a::1]:2222"}, hostPatterns([]string{"test", "fd7a::1"}, 2222))
+}
+
+func TestSelectKeys(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name: "test.example.ts.net",
+		Keys: []ssh.PublicKey{
+			in.TEST_HOST_KEY_OBJECT,
+			rsaKey,
+		},
+	}
+	reset := func() {
+		KeySelection.keyType = ""
+		KeySelection.key = ""
+		KeySelection.algorithms = defaultAlgorithms
+	}
+	defer reset()
+
+	t.Run("Default order", func(t *testing.T) {
+		reset()
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT, rsaKey}, selectKeys(host))
+	})
+
+	t.Run("Algorithm order", func(t *testing.T) {
+		reset()
+		KeySelection.algorithms = []string{ssh.KeyAlgoRSASHA512}
+		assert.Equal(t, []ssh.PublicKey{rsaKey, in.TEST_HOST_KEY_OBJECT}, selectKeys(host))
+	})
+
+	t.Run("Key type", func(t *testing.T) {
+		reset()
+		KeySelection.keyType = ts.RSA
+		assert.Equal(t, []ssh.PublicKey{rsaKey}, selectKeys(host))
+		KeySelection.keyType = "NONE"
+		assert.Len(t, selectKeys(host), 2)
+	})
+
+	t.Run("Offered key", func(t *testing.T) {
+		reset()
+		KeySelection.key = base64.StdEncoding.EncodeToString(in.TEST_HOST_KEY_OBJECT.Marshal())
+		KeySelection.keyType = ssh.KeyAlgoED25519
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT}, selectKeys(host))
+
+		// An impostor's key must not hide the advertised keys, or ssh would
+		// treat the host as new instead of reporting a changed key
+		second, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_HOST_KEY_2))
+		require.NoError(t, err)
+		other := &ts.TailscaleHost{Keys: []ssh.PublicKey{second, rsaKey}}
+		assert.Equal(t, []ssh.PublicKey{second}, selectKeys(other))
+	})
+
+	t.Run("Multiple keys of a type", func(t *testing.T) {
+		reset()
+		second, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_HOST_KEY_2))
+		require.NoError(t, err)
+		rotating := &ts.TailscaleHost{Keys: []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT, second, rsaKey}}
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT, second, rsaKey}, selectKeys(rotating))
+		KeySelection.keyType = ts.ED25519
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT, second}, selectKeys(rotating))
+	})
+
+	t.Run("Revoked key", func(t *testing.T) {
+		reset()
+		trustPolicy = &policy.Policy{Revoked: []string{ssh.FingerprintSHA256(rsaKey)}}
+		defer func() { trustPolicy = nil }()
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT}, selectKeys(host))
+	})
+}
+
+func TestLoadPolicy(t *testing.T) {
+	defer viper.Set("policy", viper.Get("policy"))
+	viper.Set("policy", map[string]any{
+		"allow": []map[string]any{
+			{"tags": []string{"server"}},
+		},
+		"require_key_expiry": true,
+		"stale_after":        "720h",
+	})
+
+	p, err := loadPolicy()
+	require.NoError(t, err)
+	assert.True(t, p.RequireKeyExpiry)
+	assert.Equal(t, 720*time.Hour, p.StaleAfter)
+	require.Len(t, p.Allow, 1)
+	assert.Equal(t, []string{"server"}, p.Allow[0].Tags)
+
+	trustPolicy = p
+	defer func() { trustPolicy = nil }()
+	assert.False(t, trusted(h), "Untagged host should be rejected")
+	assert.True(t, trusted(&ts.TailscaleHost{
+		Name:       "server",
+		Tags:       []string{"tag:server"},
+		Authorized: true,
+		KeyExpiry:  time.Now().Add(time.Hour),
+	}))
+}
+
+func TestMarkerLines(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net",
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT, rsaKey},
+		Authorized: true,
+	}
+	authorized := func(key ssh.PublicKey) string {
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+	defer func() { trustPolicy = nil }()
+
+	trustPolicy = nil
+	assert.Empty(t, markerLines([]*ts.TailscaleHost{host}, []string{"*.example.ts.net"}))
+
+	trustPolicy = &policy.Policy{
+		CertAuthorities: []policy.CertAuthority{
+			{Key: in.TEST_HOST_KEY},
+			{Key: in.TEST_RSA_HOST_KEY, Hosts: []string{"*.corp.example.com"}},
+		},
+		Revoked: []string{ssh.FingerprintSHA256(rsaKey)},
+	}
+	assert.Equal(t, []string{
+		"@cert-authority *.example.ts.net " + authorized(in.TEST_HOST_KEY_OBJECT),
+		"@cert-authority *.corp.example.com " + authorized(rsaKey),
+		"@revoked * " + authorized(rsaKey),
+	}, markerLines([]*ts.TailscaleHost{host}, []string{"*.example.ts.net"}))
+
+	t.Run("known_hosts output", func(t *testing.T) {
+		HostKeyTypes.ed25519 = true
+		HostKeyTypes.rsa = true
+		KeySelection.algorithms = defaultAlgorithms
+		lines := trustedKnownHostsLines([]*ts.TailscaleHost{host}, "example.ts.net")
+		require.Len(t, lines, 4)
+		assert.Equal(t, "@revoked * "+authorized(rsaKey), lines[2])
+		assert.True(t, strings.HasSuffix(lines[3], authorized(in.TEST_HOST_KEY_OBJECT)))
+	})
+}
+
+func TestCheckHost_Revoked(t *testing.T) {
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net",
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	getter := getterFunc(func(ctx context.Context, name string) (*ts.TailscaleHost, error) {
+		return host, nil
+	})
+	defer func() { trustPolicy = nil }()
+
+	trustPolicy = nil
+	assert.True(t, CheckHost("test", getter))
+	trustPolicy = &policy.Policy{Revoked: []string{in.TEST_HOST_KEY}}
+	assert.False(t, CheckHost("test", getter))
+}
+
+func TestCheckHost_OfferedKey(t *testing.T) {
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net",
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	getter := getterFunc(func(ctx context.Context, name string) (*ts.TailscaleHost, error) {
+		return host, nil
+	})
+	defer func() { KeySelection.key = "" }()
+
+	KeySelection.key = base64.StdEncoding.EncodeToString(in.TEST_HOST_KEY_OBJECT.Marshal())
+	assert.True(t, CheckHost("test", getter), "The advertised key should validate")
+	second, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_HOST_KEY_2))
+	require.NoError(t, err)
+	KeySelection.key = base64.StdEncoding.EncodeToString(second.Marshal())
+	assert.False(t, CheckHost("test", getter), "Any other key should be rejected")
+}
+
+func TestLoadPinGuard(t *testing.T) {
+	for _, key := range []string{"pin.enabled", "pin.path", "pin.mode", "pin.hook.log", "pin.hook.webhook"} {
+		defer viper.Set(key, viper.Get(key))
+	}
+
+	g, err := loadPinGuard()
+	require.NoError(t, err)
+	assert.Nil(t, g, "Pinning should be disabled by default")
+
+	viper.Set("pin.enabled", true)
+	viper.Set("pin.path", filepath.Join(t.TempDir(), "pins.json"))
+	viper.Set("pin.mode", "bogus")
+	_, err = loadPinGuard()
+	assert.Error(t, err)
+
+	viper.Set("pin.mode", "warn")
+	viper.Set("pin.hook.log", filepath.Join(t.TempDir(), "changes.log"))
+	g, err = loadPinGuard()
+	require.NoError(t, err)
+	assert.Equal(t, pin.Warn, g.Mode)
+	assert.Len(t, g.Hooks, 1)
+
+	viper.Set("pin.hook.webhook", "https://hooks.example.com/tailshale")
+	_, err = loadPinGuard()
+	assert.ErrorContains(t, err, "loopback", "Webhooks should only be local")
+}
+
+func TestTrusted_Pinned(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net.",
+		NodeID:     in.TEST_NODE_ID,
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	rotated := *host
+	rotated.Keys = []ssh.PublicKey{rsaKey}
+
+	keyPins = pin.NewGuard(pin.New(afero.NewMemMapFs(), "/pins.json"), pin.Fail)
+	defer func() { keyPins = nil }()
+	assert.True(t, trusted(host))
+	assert.False(t, trusted(&rotated), "Changed keys should be rejected")
+
+	r := hostRecord("test", &rotated)
+	assert.Contains(t, r.Error, "changed")
+	assert.Empty(t, r.Keys)
+}
+
+func TestAllHostsOutput_Pins(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net.",
+		NodeID:     in.TEST_NODE_ID,
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	rotated := *host
+	rotated.Keys = []ssh.PublicKey{rsaKey}
+
+	fs := afero.NewMemMapFs()
+	store := pin.New(fs, "/pins.json")
+	require.NoError(t, store.Pin(host))
+	keyPins = pin.NewGuard(store, pin.Fail)
+	keyPins.Warn = io.Discard
+	defer func() { keyPins = nil }()
+
+	records, lines, err := allHostsOutput([]*ts.TailscaleHost{&rotated}, "example.ts.net")
+	require.NoError(t, err)
+	assert.Nil(t, records)
+	assert.Empty(t, lines, "The rotated host should be rejected")
+	p, _, err := pin.New(fs, "/pins.json").Get(in.TEST_NODE_ID)
+	require.NoError(t, err)
+	assert.NotEmpty(t, p.Seen, "The change should be saved as reported even though nothing is printed")
+}
+
+func TestClientModes(t *testing.T) {
+	for _, key := range []string{"resolver", "tailnet_lock"} {
+		defer viper.Set(key, viper.Get(key))
+	}
+
+	viper.Set("resolver", "netmap")
+	viper.Set("tailnet_lock", "require")
+	resolver, lockMode, err := clientModes()
+	require.NoError(t, err)
+	assert.Equal(t, ts.ResolveNetmap, resolver)
+	assert.Equal(t, ts.LockRequire, lockMode)
+
+	viper.Set("resolver", "magicdns")
+	_, _, err = clientModes()
+	assert.ErrorContains(t, err, `invalid resolver "magicdns"`)
+
+	viper.Set("resolver", "auto")
+	viper.Set("tailnet_lock", "strict")
+	_, _, err = clientModes()
+	assert.ErrorContains(t, err, `invalid tailnet_lock mode "strict"`)
+}
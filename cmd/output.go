@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats for the known-hosts command
+const (
+	OutputKnownHosts = "known_hosts"
+	OutputJSON       = "json"
+	OutputYAML       = "yaml"
+	OutputSSHFP      = "sshfp"
+	OutputZone       = "zone"
+)
+
+var outputFormats = []string{OutputKnownHosts, OutputJSON, OutputYAML, OutputSSHFP, OutputZone}
+
+// validateOutput checks that the output format is supported.
+func validateOutput(format string) error {
+	if !slices.Contains(outputFormats, format) {
+		return fmt.Errorf("invalid output format %q, must be one of %v", format, outputFormats)
+	}
+	return nil
+}
+
+// hostRecord returns the serializable form of the host looked up by query,
+// restricted to the selected keys. Policy warnings are printed to stderr and
+// a rejection or key change is reported in the record.
+func hostRecord(query string, tsHost *ts.TailscaleHost) ts.HostRecord {
+	r := tsHost.Record()
+	r.Query = query
+	result, err := trustPolicy.Evaluate(tsHost)
+	for _, warning := range result.Warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+	r.Keys = []ts.HostKeyRecord{}
+	if err == nil {
+		err = keyPins.Check(context.Background(), tsHost)
+	}
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	for _, key := range selectKeys(tsHost) {
+		r.Keys = append(r.Keys, ts.NewHostKeyRecord(key))
+	}
+	return r
+}
+
+// lookupHostRecords looks up each node and returns a record for each one,
+// with lookup failures reported in the record's Error.
+func lookupHostRecords(nodes []string, tsclient ts.HostGetter) []ts.HostRecord {
+	records := make([]ts.HostRecord, 0, len(nodes))
+	for _, node := range nodes {
+		host, _ := splitHostPort(node)
+		tsHost, err := tsclient.GetHost(context.Background(), host)
+		if err == nil && tsHost == nil {
+			err = fmt.Errorf("no Tailscale node found for %s", host)
+		}
+		if err != nil {
+			r := ts.HostRecord{}
+			// A node without Tailscale SSH is still described
+			if tsHost != nil {
+				r = tsHost.Record()
+			}
+			r.Query = node
+			r.Keys = []ts.HostKeyRecord{}
+			r.Error = err.Error()
+			records = append(records, r)
+			continue
+		}
+		records = append(records, hostRecord(node, tsHost))
+	}
+	return records
+}
+
+// lookupTrustedHosts looks up each node, skipping any that fail, have no SSH
+// host keys or are not trusted by the policy.
+func lookupTrustedHosts(nodes []string, tsclient ts.HostGetter) []*ts.TailscaleHost {
+	hosts := []*ts.TailscaleHost{}
+	for _, node := range nodes {
+		host, _ := splitHostPort(node)
+		tsHost, err := tsclient.GetHost(context.Background(), host)
+		if err != nil || tsHost == nil || len(tsHost.Keys) == 0 || !trusted(tsHost) {
+			continue
+		}
+		hosts = append(hosts, tsHost)
+	}
+	return hosts
+}
+
+// sshfpLines returns the SSHFP records for the selected keys of each host. As
+// a zone file fragment a $TTL directive and a comment naming each host are
+// included. It returns nil if there are no records.
+func sshfpLines(hosts []*ts.TailscaleHost, zone bool) []string {
+	owners := shortNameOwners(hosts)
+	lines := []string{}
+	for _, tsHost := range hosts {
+		name, ok := sshfpOwner(tsHost, owners)
+		if !ok {
+			continue
+		}
+		records := []string{}
+		for _, key := range selectKeys(tsHost) {
+			for _, rr := range internal.SSHFPRecords(name, key, sshfpTTL) {
+				records = append(records, rr.String())
+			}
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if zone {
+			if len(lines) > 0 {
+				lines = append(lines, "")
+			}
+			lines = append(lines, "; "+strings.TrimSuffix(tsHost.Name, "."))
+		}
+		lines = append(lines, records...)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if zone {
+		lines = append([]string{fmt.Sprintf("$TTL %d", sshfpTTL)}, lines...)
+	}
+	return lines
+}
+
+// sshfpOwner returns the owner name of the host's SSHFP records, its tailnet
+// FQDN or its short name under --origin. Under an origin a short name shared
+// by more than one node is skipped, as the zone can't tell their keys apart.
+func sshfpOwner(tsHost *ts.TailscaleHost, owners map[string]*ts.TailscaleHost) (string, bool) {
+	if sshfpOrigin == "" {
+		return tsHost.Name, true
+	}
+	short := shortName(tsHost)
+	if owners[strings.ToLower(short)] != tsHost {
+		return "", false
+	}
+	return short + "." + dns.Fqdn(sshfpOrigin), true
+}
+
+// WriteHostRecords writes the records to w in the given format.
+func WriteHostRecords(w io.Writer, records []ts.HostRecord, format string) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(records)
+	case OutputYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(records); err != nil {
+			return err
+		}
+		return enc.Close()
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+// printHostRecords prints the records in the selected output format, exiting
+// with an error if none of the hosts could be looked up.
+func printHostRecords(records []ts.HostRecord) {
+	if err := WriteHostRecords(os.Stdout, records, outputFormat); err != nil {
+		fmt.Fprintln(os.Stderr, "Error writing output:", err)
+		os.Exit(1)
+	}
+	if !slices.ContainsFunc(records, func(r ts.HostRecord) bool { return r.Error == "" }) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	"github.com/evilhamsterman/tailshale/policy"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+type getterFunc func(ctx context.Context, host string) (*ts.TailscaleHost, error)
+
+func (f getterFunc) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	return f(ctx, host)
+}
+
+func TestValidateOutput(t *testing.T) {
+	assert.NoError(t, validateOutput(OutputKnownHosts))
+	assert.NoError(t, validateOutput(OutputJSON))
+	assert.NoError(t, validateOutput(OutputYAML))
+	assert.Error(t, validateOutput("xml"))
+}
+
+func TestLookupHostRecords(t *testing.T) {
+	HostKeyTypes.ed25519 = true
+	KeySelection.keyType = ""
+	KeySelection.key = ""
+	KeySelection.algorithms = defaultAlgorithms
+	trustPolicy = nil
+	authorized := *h
+	authorized.Authorized = true
+	getter := getterFunc(func(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+		if host == "test" {
+			return &authorized, nil
+		}
+		return nil, fmt.Errorf("unknown host %s", host)
+	})
+
+	records := lookupHostRecords([]string{"[test]:2222", "missing"}, getter)
+	require.Len(t, records, 2)
+	assert.Equal(t, "[test]:2222", records[0].Query)
+	assert.Equal(t, "test.example.ts.net", records[0].Name)
+	assert.Empty(t, records[0].Error)
+	require.Len(t, records[0].Keys, 1)
+	assert.Equal(t, ssh.KeyAlgoED25519, records[0].Keys[0].Type)
+	assert.Equal(t, "missing", records[1].Query)
+	assert.Equal(t, "unknown host missing", records[1].Error)
+	assert.Empty(t, records[1].Keys)
+
+	t.Run("SSH not enabled", func(t *testing.T) {
+		noSSH := authorized
+		noSSH.Keys = nil
+		getter := getterFunc(func(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+			return &noSSH, &ts.SSHNotEnabledError{Host: noSSH.Name}
+		})
+		records := lookupHostRecords([]string{"test"}, getter)
+		require.Len(t, records, 1)
+		assert.Equal(t, "test", records[0].Query)
+		assert.Equal(t, "test.example.ts.net", records[0].Name, "The node should be described")
+		assert.Equal(t, []string{in.TEST_IP.String(), in.TEST_IP6.String()}, records[0].IPs)
+		assert.False(t, records[0].SSHEnabled)
+		assert.NotEmpty(t, records[0].Error)
+		assert.NotNil(t, records[0].Keys)
+	})
+
+	t.Run("rejected by policy", func(t *testing.T) {
+		trustPolicy = &policy.Policy{Allow: []policy.Rule{{Tags: []string{"tag:prod"}}}}
+		defer func() { trustPolicy = nil }()
+		records := lookupHostRecords([]string{"test"}, getter)
+		require.Len(t, records, 1)
+		assert.NotEmpty(t, records[0].Error)
+		assert.Empty(t, records[0].Keys)
+	})
+}
+
+func TestWriteHostRecords(t *testing.T) {
+	records := []ts.HostRecord{
+		h.Record(),
+		{Query: "missing", Keys: []ts.HostKeyRecord{}, Error: "unknown host missing"},
+	}
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteHostRecords(&buf, records, OutputJSON))
+		var decoded []ts.HostRecord
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, records, decoded)
+		assert.Contains(t, buf.String(), `"ssh_enabled": true`)
+		assert.Contains(t, buf.String(), `"error": "unknown host missing"`)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, WriteHostRecords(&buf, records, OutputYAML))
+		var decoded []ts.HostRecord
+		require.NoError(t, yaml.Unmarshal(buf.Bytes(), &decoded))
+		assert.Equal(t, records, decoded)
+		assert.Contains(t, buf.String(), "fingerprint: SHA256:")
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		assert.Error(t, WriteHostRecords(&bytes.Buffer{}, records, OutputKnownHosts))
+	})
+}
+
+func TestSSHFPLines(t *testing.T) {
+	HostKeyTypes.ed25519 = true
+	KeySelection.keyType = ""
+	KeySelection.key = ""
+	KeySelection.algorithms = defaultAlgorithms
+	sshfpTTL = 300
+	other := &ts.TailscaleHost{
+		Name: "other.example.ts.net.",
+		Keys: h.Keys,
+	}
+
+	lines := sshfpLines([]*ts.TailscaleHost{h}, false)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "test.example.ts.net.\t300\tIN\tSSHFP\t4 1 6763A7D444AAD2CA871B7DA8E8A7AF89A59F4217", lines[0])
+	assert.Equal(t, "test.example.ts.net.\t300\tIN\tSSHFP\t4 2 6F1D90C26F656F01DE952C7B906D3F27055FBABB8E20C88AF3B7519F417835E4", lines[1])
+
+	assert.Nil(t, sshfpLines([]*ts.TailscaleHost{{Name: "nossh.example.ts.net"}}, true))
+
+	t.Run("zone", func(t *testing.T) {
+		lines := sshfpLines([]*ts.TailscaleHost{h, other}, true)
+		assert.Equal(t, "$TTL 300", lines[0])
+		assert.Equal(t, "; test.example.ts.net", lines[1])
+		assert.Contains(t, lines, "; other.example.ts.net")
+
+		zp := dns.NewZoneParser(strings.NewReader(strings.Join(lines, "\n")+"\n"), "", "")
+		count := 0
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			assert.Equal(t, dns.TypeSSHFP, rr.Header().Rrtype)
+			count++
+		}
+		require.NoError(t, zp.Err())
+		assert.Equal(t, 4, count)
+	})
+
+	t.Run("Origin", func(t *testing.T) {
+		defer func(origin string) { sshfpOrigin = origin }(sshfpOrigin)
+		sshfpOrigin = "internal.example.com"
+		shared := &ts.TailscaleHost{Name: "other.shared.ts.net.", Keys: h.Keys, Shared: true}
+		lines := sshfpLines([]*ts.TailscaleHost{h, other, shared}, true)
+
+		zp := dns.NewZoneParser(strings.NewReader(strings.Join(lines, "\n")+"\n"), "", "")
+		owners := map[string]int{}
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			owners[rr.Header().Name]++
+		}
+		require.NoError(t, zp.Err())
+		assert.Equal(t, map[string]int{
+			"test.internal.example.com.":  2,
+			"other.internal.example.com.": 2,
+		}, owners, "The shared node should lose the short name to the local one")
+	})
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/evilhamsterman/tailshale/pin"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/cobra"
+)
+
+var pinCmd = &cobra.Command{
+	Use:   "pin HOST...",
+	Short: "Pin the SSH host keys the hosts currently advertise",
+	Long: strings.TrimLeft(`
+Record the SSH host keys the hosts currently advertise in the pin store,
+replacing their existing pins. Use it to accept a legitimate key rotation
+after a host was rejected in the fail pin mode, or to stop warnings in the
+warn mode. Pinning must be enabled with pin.enabled.`, "\n"),
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		g, err := loadPinGuard()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading pin configuration:", err)
+			os.Exit(1)
+		}
+		if g == nil {
+			fmt.Fprintln(os.Stderr, "Error: key pinning is not enabled, set pin.enabled in the configuration")
+			os.Exit(1)
+		}
+		c, err := newHostGetter()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
+		hosts, err := RepinHosts(context.Background(), g.Store, args, c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error pinning host keys:", err)
+			os.Exit(1)
+		}
+		for _, host := range hosts {
+			cmd.Printf("Pinned %d keys for %s\n", len(host.Keys), host.Name)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(pinCmd)
+}
+
+// RepinHosts looks up each node and pins the SSH host keys it currently
+// advertises. Nothing is pinned unless every node is found with keys.
+func RepinHosts(ctx context.Context, store *pin.Store, nodes []string, tsclient ts.HostGetter) ([]*ts.TailscaleHost, error) {
+	hosts := make([]*ts.TailscaleHost, 0, len(nodes))
+	for _, node := range nodes {
+		host, _ := splitHostPort(node)
+		tsHost, err := tsclient.GetHost(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("Error looking up %s: %w", host, err)
+		}
+		switch {
+		case tsHost == nil:
+			return nil, fmt.Errorf("no Tailscale node found for %s", host)
+		case len(tsHost.Keys) == 0:
+			return nil, fmt.Errorf("%s has no SSH host keys", host)
+		case tsHost.NodeID == "":
+			return nil, fmt.Errorf("%s has no stable node ID and can't be pinned", host)
+		}
+		hosts = append(hosts, tsHost)
+	}
+	err := store.Batch(func() error {
+		for _, tsHost := range hosts {
+			if err := store.Pin(tsHost); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
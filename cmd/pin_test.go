@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	"github.com/evilhamsterman/tailshale/pin"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRepinHosts(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name:       "test.example.ts.net.",
+		NodeID:     in.TEST_NODE_ID,
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Authorized: true,
+	}
+	getter := getterFunc(func(ctx context.Context, name string) (*ts.TailscaleHost, error) {
+		if name == "test" {
+			return host, nil
+		}
+		return nil, nil
+	})
+
+	store := pin.New(afero.NewMemMapFs(), "/pins.json")
+	g := pin.NewGuard(store, pin.Fail)
+	require.NoError(t, g.Check(context.TODO(), host))
+	rotated := *host
+	rotated.Keys = []ssh.PublicKey{rsaKey}
+	host = &rotated
+	assert.Error(t, g.Check(context.TODO(), host), "The rotated keys should be rejected")
+
+	_, err = RepinHosts(context.TODO(), store, []string{"test", "missing"}, getter)
+	assert.ErrorContains(t, err, "missing")
+	assert.Error(t, g.Check(context.TODO(), host), "Nothing should be pinned if a host is missing")
+
+	hosts, err := RepinHosts(context.TODO(), store, []string{"test"}, getter)
+	require.NoError(t, err)
+	assert.Equal(t, []*ts.TailscaleHost{host}, hosts)
+	assert.NoError(t, g.Check(context.TODO(), host), "The repinned keys should be trusted")
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// PruneStale is an entry for a Tailscale address or name that no longer
+	// belongs to a node
+	PruneStale = "stale"
+	// PruneConflict is an entry with a key the node does not advertise
+	PruneConflict = "conflict"
+)
+
+var (
+	dryRun     bool
+	pruneFiles []string
+)
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove stale and conflicting Tailscale entries from known_hosts files",
+	Long: strings.TrimLeft(`
+Find entries in your known_hosts files for Tailscale addresses and names,
+compare them with the host keys currently advertised by the tailnet, and
+remove entries that are stale or conflict with them. When an entry also lists
+other hosts only the stale and conflicting ones are removed. A backup of each file
+is made before it is changed.
+
+Hashed entries can only be matched against nodes currently in the tailnet, so
+hashed entries for nodes that no longer exist are not found. Entries for
+nodes without Tailscale SSH are never removed.`, "\n"),
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		c, err := newTSClient()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
+		p, err := NewPruner(context.Background(), c)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error listing Tailscale peers:", err)
+			os.Exit(1)
+		}
+		fs := afero.NewOsFs()
+		for _, path := range viper.GetStringSlice("prune.files") {
+			results, backup, err := PruneKnownHosts(fs, path, p, dryRun)
+			if err != nil {
+				cmd.PrintErrf("Error pruning %s: %v\n", path, err)
+				os.Exit(1)
+			}
+			for _, r := range results {
+				cmd.Printf("%s:%d: %s entry for %s\n", path, r.Line, r.Reason, r.Host)
+			}
+			if backup != "" {
+				cmd.Printf("Removed %d entries from %s, backup saved to %s\n", len(results), path, backup)
+			}
+		}
+	},
+}
+
+func init() {
+	pruneCmd.Flags().BoolVar(&dryRun, "dry-run", false, "Only report entries that would be removed")
+	pruneCmd.Flags().StringSliceVar(&pruneFiles, "file", nil, "known_hosts files to prune (default ~/.ssh/known_hosts,~/.ssh/known_hosts2)")
+	viper.BindPFlag("prune.files", pruneCmd.Flags().Lookup("file")) //nolint:errcheck
+	rootCmd.AddCommand(pruneCmd)
+}
+
+// PruneResult describes an entry removed from a known_hosts file
+type PruneResult struct {
+	Line   int
+	Host   string
+	Reason string
+}
+
+// Pruner classifies known_hosts entries against the current tailnet
+type Pruner struct {
+	client *ts.TSClient
+	hosts  map[string]*ts.TailscaleHost
+}
+
+// NewPruner indexes every node in the tailnet, including this one, by
+// address and DNS name. Peers that fail Tailnet Lock verification are still
+// in the tailnet, so they are indexed without keys and their entries are
+// never removed.
+func NewPruner(ctx context.Context, c *ts.TSClient) (*Pruner, error) {
+	filter := ts.PeerFilter{AllPeers: true, Self: true}
+	peers, err := c.GetAllHosts(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &Pruner{client: c, hosts: make(map[string]*ts.TailscaleHost)}
+	if c.TailnetLock != "" && c.TailnetLock != ts.LockOff {
+		unverified := *c
+		unverified.TailnetLock = ts.LockOff
+		all, err := unverified.GetAllHosts(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range all {
+			p.add(&ts.TailscaleHost{Name: h.Name, NodeID: h.NodeID, IPs: h.IPs})
+		}
+	}
+	// Verified peers replace their keyless entries
+	for _, h := range peers {
+		p.add(h)
+	}
+	return p, nil
+}
+
+// add indexes the host by its addresses and DNS name
+func (p *Pruner) add(h *ts.TailscaleHost) {
+	for _, ip := range h.IPs {
+		p.hosts[ip.String()] = h
+	}
+	if name := strings.TrimSuffix(strings.ToLower(h.Name), "."); name != "" {
+		p.hosts[name] = h
+	}
+}
+
+// isTailnet reports whether the host is a Tailscale address or a name in the
+// tailnet
+func (p *Pruner) isTailnet(host string) bool {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return p.client.IsTailscaleNode(context.Background(), ip)
+	}
+	return p.client.Tailnet != "" && strings.HasSuffix(host, "."+strings.ToLower(p.client.Tailnet))
+}
+
+// Classify returns the reason an entry should be removed and the host it was
+// matched on, or an empty reason if it should be kept. An entry is only
+// removed if none of its patterns are left, see ConflictPatterns and
+// StalePatterns for the rest.
+func (p *Pruner) Classify(entry internal.KnownHostsEntry) (string, string) {
+	if entry.Key == nil || entry.Marker != "" || len(entry.Hosts) == 0 {
+		return "", ""
+	}
+	conflicting := p.ConflictPatterns(entry)
+	stale := p.StalePatterns(entry)
+	if len(conflicting)+len(stale) < len(entry.Hosts) {
+		return "", ""
+	}
+	if len(conflicting) > 0 {
+		return PruneConflict, p.conflictHost(entry, conflicting[0])
+	}
+	host, _ := internal.SplitKnownHostsPattern(stale[0])
+	return PruneStale, strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// ConflictPatterns returns the entry's patterns for nodes that advertise
+// host keys other than the entry key.
+func (p *Pruner) ConflictPatterns(entry internal.KnownHostsEntry) []string {
+	if entry.Key == nil || entry.Marker != "" {
+		return nil
+	}
+	var conflicting []string
+	for _, pattern := range entry.Hosts {
+		if p.conflictHost(entry, pattern) != "" {
+			conflicting = append(conflicting, pattern)
+		}
+	}
+	return conflicting
+}
+
+// conflictHost returns the node address or name the pattern matched if the
+// node doesn't advertise the entry key, or an empty string otherwise.
+func (p *Pruner) conflictHost(entry internal.KnownHostsEntry, pattern string) string {
+	if strings.HasPrefix(pattern, "|1|") {
+		for name, h := range p.hosts {
+			if internal.MatchHashedHost(pattern, name) && conflicts(h, entry) {
+				return name
+			}
+		}
+		return ""
+	}
+	host, port := internal.SplitKnownHostsPattern(pattern)
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	// Tailscale SSH only listens on the default port
+	if h, ok := p.hosts[host]; ok && (port == "" || port == "22") && conflicts(h, entry) {
+		return host
+	}
+	return ""
+}
+
+// StalePatterns returns the entry's patterns for Tailscale addresses and
+// names that no longer belong to a node.
+func (p *Pruner) StalePatterns(entry internal.KnownHostsEntry) []string {
+	if entry.Key == nil || entry.Marker != "" {
+		return nil
+	}
+	var stale []string
+	for _, pattern := range entry.Hosts {
+		// Hashed patterns can't be told apart from hosts outside the tailnet
+		if strings.HasPrefix(pattern, "|1|") {
+			continue
+		}
+		host, _ := internal.SplitKnownHostsPattern(pattern)
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if _, ok := p.hosts[host]; !ok && p.isTailnet(host) {
+			stale = append(stale, pattern)
+		}
+	}
+	return stale
+}
+
+// conflicts reports whether the node advertises host keys and the entry key
+// is not one of them
+func conflicts(h *ts.TailscaleHost, entry internal.KnownHostsEntry) bool {
+	if len(h.Keys) == 0 {
+		return false
+	}
+	for _, key := range h.Keys {
+		if bytes.Equal(key.Marshal(), entry.Key.Marshal()) {
+			return false
+		}
+	}
+	return true
+}
+
+// PruneKnownHosts removes stale and conflicting entries from the known_hosts
+// file. Unless dryRun is set the original file is backed up and the path of
+// the backup returned.
+func PruneKnownHosts(fs afero.Fs, path string, p *Pruner, dryRun bool) ([]PruneResult, string, error) {
+	content, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("Error reading known_hosts file: %w", err)
+	}
+
+	var results []PruneResult
+	var kept strings.Builder
+	for i, entry := range internal.ParseKnownHosts(string(content)) {
+		reason, host := p.Classify(entry)
+		if reason != "" {
+			results = append(results, PruneResult{Line: i + 1, Host: host, Reason: reason})
+			continue
+		}
+		// Only the conflicting and stale patterns are removed from entries
+		// that also list current hosts
+		conflicting := p.ConflictPatterns(entry)
+		if len(conflicting) > 0 {
+			hosts := make([]string, len(conflicting))
+			for j, pattern := range conflicting {
+				hosts[j] = p.conflictHost(entry, pattern)
+			}
+			results = append(results, PruneResult{Line: i + 1, Host: strings.Join(hosts, ","), Reason: PruneConflict})
+		}
+		stale := p.StalePatterns(entry)
+		if len(stale) > 0 {
+			results = append(results, PruneResult{Line: i + 1, Host: strings.Join(stale, ","), Reason: PruneStale})
+		}
+		if remove := append(conflicting, stale...); len(remove) > 0 {
+			kept.WriteString(internal.RemoveKnownHostsPatterns(entry, remove))
+			continue
+		}
+		kept.WriteString(entry.Line)
+	}
+	if dryRun || len(results) == 0 {
+		return results, "", nil
+	}
+
+	info, err := fs.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("Error reading known_hosts file: %w", err)
+	}
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102T150405"))
+	if err := afero.WriteFile(fs, backup, content, info.Mode().Perm()); err != nil {
+		return nil, "", fmt.Errorf("Error writing backup: %w", err)
+	}
+	if _, err := WriteFileIfChanged(fs, path, []byte(kept.String()), info.Mode().Perm()); err != nil {
+		return nil, "", err
+	}
+	return results, backup, nil
+}
@@ -0,0 +1,184 @@
+//nolint:errcheck
+package cmd
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func newTestPruner(t *testing.T) *Pruner {
+	m := new(in.MockClient)
+	m.On("Status", mock.Anything).Return(&ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "self." + in.TEST_TAILNET + ".",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.5")},
+			SSH_HostKeys: []string{in.TEST_HOST_KEY},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{in.TEST_IP},
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "openssh." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.2")},
+			},
+		},
+	}, nil)
+	p, err := NewPruner(context.TODO(), &ts.TSClient{Client: m, Tailnet: in.TEST_TAILNET})
+	require.NoError(t, err)
+	return p
+}
+
+func TestPruner_Classify(t *testing.T) {
+	p := newTestPruner(t)
+	rsaKey := in.TEST_RSA_HOST_KEY
+
+	tests := []struct {
+		name   string
+		line   string
+		reason string
+	}{
+		{"Matching key", "100.100.100.100 " + in.TEST_HOST_KEY, ""},
+		{"Conflicting key", "100.100.100.100 " + rsaKey, PruneConflict},
+		{"Conflicting key by name", "test.example.ts.net " + rsaKey, PruneConflict},
+		{"Conflicting hashed", knownhosts.HashHostname("100.100.100.100") + " " + rsaKey, PruneConflict},
+		{"Matching hashed", knownhosts.HashHostname("100.100.100.100") + " " + in.TEST_HOST_KEY, ""},
+		{"Other port", "[100.100.100.100]:2222 " + rsaKey, ""},
+		{"No Tailscale SSH", "100.100.100.2 " + rsaKey, ""},
+		{"Stale IP", "100.100.100.3 " + rsaKey, PruneStale},
+		{"Stale name", "gone.example.ts.net " + rsaKey, PruneStale},
+		{"Self IP", "100.100.100.5 " + in.TEST_HOST_KEY, ""},
+		{"Self name", "self.example.ts.net " + in.TEST_HOST_KEY, ""},
+		{"Self conflict", "self.example.ts.net " + rsaKey, PruneConflict},
+		{"Mixed stale and current", "test.example.ts.net,100.100.100.3 " + in.TEST_HOST_KEY, ""},
+		{"Mixed conflict and other host", "myhost.example.com,100.100.100.100 " + rsaKey, ""},
+		{"Conflict and stale", "test.example.ts.net,100.100.100.3 " + rsaKey, PruneConflict},
+		{"All stale", "gone.example.ts.net,100.100.100.3 " + rsaKey, PruneStale},
+		{"Not Tailscale", "192.168.0.1,example.com " + rsaKey, ""},
+		{"Marker", "@revoked 100.100.100.3 " + rsaKey, ""},
+		{"Comment", "# 100.100.100.3", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := in.ParseKnownHosts(tt.line)
+			require.Len(t, entries, 1)
+			reason, _ := p.Classify(entries[0])
+			assert.Equal(t, tt.reason, reason)
+		})
+	}
+}
+
+func TestPruneKnownHosts(t *testing.T) {
+	path := "/home/user/.ssh/known_hosts"
+	p := newTestPruner(t)
+	original := strings.Join([]string{
+		"example.com " + in.TEST_RSA_HOST_KEY,
+		"100.100.100.100 " + in.TEST_RSA_HOST_KEY,
+		"100.100.100.3 " + in.TEST_RSA_HOST_KEY,
+		"",
+	}, "\n")
+
+	t.Run("Dry run", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, path, []byte(original), 0600)
+		results, backup, err := PruneKnownHosts(fs, path, p, true)
+		require.NoError(t, err)
+		assert.Len(t, results, 2)
+		assert.Empty(t, backup)
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, original, string(content))
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, path, []byte(original), 0600)
+		results, backup, err := PruneKnownHosts(fs, path, p, false)
+		require.NoError(t, err)
+		require.Len(t, results, 2)
+		assert.Equal(t, PruneResult{Line: 2, Host: "100.100.100.100", Reason: PruneConflict}, results[0])
+		assert.Equal(t, PruneResult{Line: 3, Host: "100.100.100.3", Reason: PruneStale}, results[1])
+
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, "example.com "+in.TEST_RSA_HOST_KEY+"\n", string(content))
+		saved, _ := afero.ReadFile(fs, backup)
+		assert.Equal(t, original, string(saved))
+	})
+
+	t.Run("Mixed entry", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		mixed := "test.example.ts.net,100.100.100.3,100.100.100.100 " + in.TEST_HOST_KEY + "\n" +
+			"@cert-authority *.example.ts.net " + in.TEST_RSA_HOST_KEY + "\n" +
+			"self.example.ts.net,100.100.100.5 " + in.TEST_HOST_KEY + "\n"
+		afero.WriteFile(fs, path, []byte(mixed), 0600)
+		results, _, err := PruneKnownHosts(fs, path, p, false)
+		require.NoError(t, err)
+		assert.Equal(t, []PruneResult{{Line: 1, Host: "100.100.100.3", Reason: PruneStale}}, results)
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, strings.Replace(mixed, "100.100.100.3,", "", 1), string(content), "Only the stale pattern should be removed")
+	})
+
+	t.Run("Conflicting pattern", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		conflict := "myhost.example.com,100.100.100.100,100.100.100.3 " + in.TEST_RSA_HOST_KEY + "\n"
+		afero.WriteFile(fs, path, []byte(conflict), 0600)
+		results, _, err := PruneKnownHosts(fs, path, p, false)
+		require.NoError(t, err)
+		assert.Equal(t, []PruneResult{
+			{Line: 1, Host: "100.100.100.100", Reason: PruneConflict},
+			{Line: 1, Host: "100.100.100.3", Reason: PruneStale},
+		}, results)
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, "myhost.example.com "+in.TEST_RSA_HOST_KEY+"\n", string(content), "Other hosts on the line should be kept")
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		results, _, err := PruneKnownHosts(afero.NewMemMapFs(), path, p, false)
+		assert.NoError(t, err)
+		assert.Empty(t, results)
+	})
+}
+
+func TestNewPruner_TailnetLock(t *testing.T) {
+	filtered := key.NewNode().Public()
+	m := new(in.MockClient)
+	m.On("Status", mock.Anything).Return(&ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			filtered: {
+				DNSName:      "locked." + in.TEST_TAILNET + ".",
+				PublicKey:    filtered,
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.4")},
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+		},
+	}, nil)
+	m.On("NetworkLockStatus", mock.Anything).Return(&ipnstate.NetworkLockStatus{
+		Enabled:       true,
+		FilteredPeers: []*ipnstate.TKAPeer{{NodeKey: filtered}},
+	}, nil)
+	p, err := NewPruner(context.TODO(), &ts.TSClient{Client: m, Tailnet: in.TEST_TAILNET, TailnetLock: ts.LockAuto})
+	require.NoError(t, err)
+
+	for _, line := range []string{
+		"100.100.100.4 " + in.TEST_RSA_HOST_KEY,
+		"locked.example.ts.net " + in.TEST_HOST_KEY,
+	} {
+		entries := in.ParseKnownHosts(line)
+		reason, _ := p.Classify(entries[0])
+		assert.Empty(t, reason, "Entries for peers filtered by Tailnet Lock should be kept: %s", line)
+		assert.Empty(t, p.StalePatterns(entries[0]))
+	}
+}
@@ -7,6 +7,10 @@ import (
 	"path/filepath"
 
 	"github.com/charmbracelet/fang"
+	"github.com/evilhamsterman/tailshale/cache"
+	"github.com/evilhamsterman/tailshale/daemon"
+	"github.com/evilhamsterman/tailshale/pin"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -48,9 +52,37 @@ func initConfig() {
 	if err != nil {
 		fmt.Println("Error getting user home directory:", err)
 	}
+	cachePath, err := cache.DefaultPath()
+	if err != nil {
+		fmt.Println("Error getting user cache directory:", err)
+	}
+	socketPath, err := daemon.DefaultSocketPath()
+	if err != nil {
+		fmt.Println("Error getting daemon socket path:", err)
+	}
+	pinPath, err := pin.DefaultPath()
+	if err != nil {
+		fmt.Println("Error getting pin store path:", err)
+	}
 	// Set defaults
 	viper.SetDefault("config", filepath.Join(confDir, "tailshale", "config.yaml"))
 	viper.SetDefault("ssh_config", filepath.Join(homeDir, ".ssh/config"))
+	viper.SetDefault("sync.output", filepath.Join(homeDir, ".ssh/known_hosts.tailscale"))
+	viper.SetDefault("prune.files", []string{
+		filepath.Join(homeDir, ".ssh/known_hosts"),
+		filepath.Join(homeDir, ".ssh/known_hosts2"),
+	})
+	viper.SetDefault("resolver", string(ts.ResolveAuto))
+	viper.SetDefault("tailnet_lock", string(ts.LockAuto))
+	viper.SetDefault("cache.enabled", true)
+	viper.SetDefault("cache.ttl", cache.DefaultTTL)
+	viper.SetDefault("cache.path", cachePath)
+	viper.SetDefault("daemon.socket", socketPath)
+	viper.SetDefault("configure.include_file", filepath.Join(homeDir, ".ssh/config.d/tailshale.conf"))
+	viper.SetDefault("configure.backups", 5)
+	viper.SetDefault("pin.enabled", false)
+	viper.SetDefault("pin.path", pinPath)
+	viper.SetDefault("pin.mode", string(pin.Fail))
 
 	// Set the configuration file name and path
 	viper.SetEnvPrefix("TAILSHALE")
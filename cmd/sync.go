@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/evilhamsterman/tailshale/daemon"
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"tailscale.com/client/local"
+)
+
+var watch bool
+
+var syncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Write SSH host keys for the tailnet to a known_hosts file",
+	Long: strings.TrimLeft(`
+Write the SSH host keys of every Tailscale node with Tailscale SSH enabled to a
+static known_hosts file, for SSH clients that do not support
+KnownHostsCommand. The file is only rewritten when its content changes. With
+--watch the file is kept up to date as the tailnet changes.`, "\n"),
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		if trustPolicy, err = loadPolicy(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading policy:", err)
+			os.Exit(1)
+		}
+		if keyPins, err = loadPinGuard(); err != nil {
+			fmt.Fprintln(os.Stderr, "Error reading pin configuration:", err)
+			os.Exit(1)
+		}
+		c, err := newTSClient()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error connecting to Tailscale:", err)
+			os.Exit(1)
+		}
+		fs := afero.NewOsFs()
+		output := viper.GetString("sync.output")
+
+		update := func(ctx context.Context) error {
+			changed, err := SyncKnownHosts(ctx, fs, output, c)
+			if err != nil {
+				return err
+			}
+			if changed {
+				cmd.Println("Updated", output)
+			}
+			return nil
+		}
+
+		if !watch {
+			if err := update(context.Background()); err != nil {
+				cmd.PrintErrln("Error syncing known hosts:", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = daemon.WatchNetmap(ctx, daemon.LocalWatch(&local.Client{}), update, func(format string, args ...any) {
+			cmd.PrintErrf(format+"\n", args...)
+		})
+		if err != nil {
+			cmd.PrintErrln("Error watching netmap:", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	syncCmd.Flags().StringP("output", "o", "", "known_hosts file to write (default ~/.ssh/known_hosts.tailscale)")
+	viper.BindPFlag("sync.output", syncCmd.Flags().Lookup("output")) //nolint:errcheck
+	syncCmd.Flags().BoolVar(&watch, "watch", false, "Keep running and update the file when the tailnet changes")
+	rootCmd.AddCommand(syncCmd)
+}
+
+// SyncKnownHosts writes the known_hosts lines for every trusted SSH enabled
+// peer to path. It reports whether the file changed.
+func SyncKnownHosts(ctx context.Context, fs afero.Fs, path string, tsclient *ts.TSClient) (bool, error) {
+	hosts, err := tsclient.GetAllHosts(ctx, ts.PeerFilter{})
+	if err != nil {
+		return false, fmt.Errorf("Error listing Tailscale peers: %w", err)
+	}
+	// Check every host's pin with one read and write of the pin store
+	var lines []string
+	err = keyPins.Batch(func() error {
+		lines = trustedKnownHostsLines(hosts, tsclient.Tailnet)
+		return nil
+	})
+	if err != nil {
+		return false, fmt.Errorf("Error updating pin store: %w", err)
+	}
+	content := "# Generated by tailshale sync. Do not edit manually.\n"
+	if len(lines) > 0 {
+		content += strings.Join(lines, "\n") + "\n"
+	}
+	return WriteFileIfChanged(fs, path, []byte(content), 0644)
+}
+
+// WriteFileIfChanged atomically replaces the file with the content. The file
+// is left untouched if the content is the same. It reports whether the file
+// changed.
+func WriteFileIfChanged(fs afero.Fs, path string, content []byte, perm os.FileMode) (bool, error) {
+	if existing, err := afero.ReadFile(fs, path); err == nil && bytes.Equal(existing, content) {
+		return false, nil
+	}
+	if err := internal.WriteFileAtomic(fs, path, content, perm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
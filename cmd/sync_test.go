@@ -0,0 +1,66 @@
+//nolint:errcheck
+package cmd
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestWriteFileIfChanged(t *testing.T) {
+	path := "/home/user/.ssh/known_hosts.tailscale"
+	fs := afero.NewMemMapFs()
+
+	changed, err := WriteFileIfChanged(fs, path, []byte("one\n"), 0644)
+	require.NoError(t, err)
+	assert.True(t, changed, "New file should be written")
+
+	changed, err = WriteFileIfChanged(fs, path, []byte("one\n"), 0644)
+	require.NoError(t, err)
+	assert.False(t, changed, "Unchanged content should not be written")
+
+	changed, err = WriteFileIfChanged(fs, path, []byte("two\n"), 0644)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	content, _ := afero.ReadFile(fs, path)
+	assert.Equal(t, "two\n", string(content))
+
+	files, _ := afero.ReadDir(fs, "/home/user/.ssh")
+	assert.Len(t, files, 1, "Temporary files should be cleaned up")
+}
+
+func TestSyncKnownHosts(t *testing.T) {
+	path := "/home/user/.ssh/known_hosts.tailscale"
+	fs := afero.NewMemMapFs()
+	m := new(in.MockClient)
+	m.On("Status", mock.Anything).Return(&ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{in.TEST_IP},
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+		},
+	}, nil)
+	c := &ts.TSClient{Client: m, Tailnet: in.TEST_TAILNET}
+	HostKeyTypes.ed25519 = true
+
+	changed, err := SyncKnownHosts(context.TODO(), fs, path, c)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	content, _ := afero.ReadFile(fs, path)
+	assert.Contains(t, string(content), in.TEST_IP.String()+",test.example.ts.net.,test.example.ts.net,test ssh-ed25519 ")
+
+	changed, err = SyncKnownHosts(context.TODO(), fs, path, c)
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
@@ -0,0 +1,95 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+)
+
+// dialTimeout is how long to wait for the daemon socket before falling back
+// to querying tailscaled directly.
+const dialTimeout = 200 * time.Millisecond
+
+// Client looks up hosts from a running daemon.
+type Client struct {
+	http *http.Client
+	// Fallback connects to the client used for hosts the daemon doesn't know
+	// about, such as names only MagicDNS can resolve. Misses are errors if it
+	// is nil.
+	Fallback func() (ts.HostGetter, error)
+	upstream ts.HostGetter
+}
+
+var _ ts.HostGetter = (*Client)(nil) // Ensure Client can be used in place of a TSClient
+
+// Dial connects to the daemon socket, returning an error if the daemon is not
+// running.
+func Dial(path string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		},
+	}, nil
+}
+
+// GetHost looks up the host in the daemon index, using the fallback if the
+// daemon doesn't have it or can't be reached.
+func (c *Client) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	u := "http://tailshale/host?name=" + url.QueryEscape(host)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		if c.Fallback != nil {
+			return c.fallback(ctx, host)
+		}
+		return nil, fmt.Errorf("failed to query tailshale daemon: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && c.Fallback != nil {
+		return c.fallback(ctx, host)
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, errors.New(strings.TrimSpace(string(msg)))
+	}
+	tsHost := &ts.TailscaleHost{}
+	if err := json.NewDecoder(resp.Body).Decode(tsHost); err != nil {
+		return nil, fmt.Errorf("failed to decode daemon response: %w", err)
+	}
+	return tsHost, nil
+}
+
+// fallback looks up the host with the fallback client, connecting on first
+// use.
+func (c *Client) fallback(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	if c.upstream == nil {
+		upstream, err := c.Fallback()
+		if err != nil {
+			return nil, err
+		}
+		c.upstream = upstream
+	}
+	return c.upstream.GetHost(ctx, host)
+}
@@ -0,0 +1,231 @@
+// Package daemon keeps an in-memory index of the tailnet host keys, updated
+// from the IPN bus, and serves lookups over a Unix socket.
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"tailscale.com/client/local"
+	"tailscale.com/ipn"
+)
+
+// reconnectDelay is how long to wait before watching the IPN bus again after
+// it fails, for example when tailscaled restarts.
+const reconnectDelay = 5 * time.Second
+
+// DefaultSocketPath returns the default location of the daemon socket, in the
+// user runtime directory if there is one, otherwise the user cache directory.
+func DefaultSocketPath() (string, error) {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserCacheDir(); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, "tailshale", "daemon.sock"), nil
+}
+
+// Index maps host names and addresses to hosts.
+type Index struct {
+	mu    sync.RWMutex
+	hosts map[string]*ts.TailscaleHost
+}
+
+func NewIndex() *Index {
+	return &Index{hosts: make(map[string]*ts.TailscaleHost)}
+}
+
+func indexKey(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Update replaces the contents of the index. Hosts are indexed by their IP
+// addresses, DNS name and short name. Short names of nodes in this tailnet
+// take precedence over nodes shared in from other tailnets, and short names
+// that are ambiguous are left out.
+func (i *Index) Update(hosts []*ts.TailscaleHost) {
+	index := make(map[string]*ts.TailscaleHost)
+	shortNames := make(map[string]*ts.TailscaleHost)
+	ambiguous := make(map[string]bool)
+	for _, h := range hosts {
+		for _, ip := range h.IPs {
+			index[ip.String()] = h
+		}
+		name := indexKey(h.Name)
+		index[name] = h
+		short, _, _ := strings.Cut(name, ".")
+		prev, ok := shortNames[short]
+		switch {
+		case !ok, prev.Shared && !h.Shared:
+			shortNames[short] = h
+			delete(ambiguous, short)
+		case prev.Shared == h.Shared:
+			ambiguous[short] = true
+		}
+	}
+	for short, h := range shortNames {
+		if _, ok := index[short]; !ok && !ambiguous[short] {
+			index[short] = h
+		}
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.hosts = index
+}
+
+// Lookup returns the host for a name or IP address.
+func (i *Index) Lookup(host string) (*ts.TailscaleHost, bool) {
+	key := indexKey(host)
+	if addr, err := netip.ParseAddr(host); err == nil {
+		key = addr.String()
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	h, ok := i.hosts[key]
+	return h, ok
+}
+
+// Watcher returns IPN bus notifications.
+type Watcher interface {
+	Next() (ipn.Notify, error)
+	Close() error
+}
+
+// Daemon keeps the index up to date and serves it.
+type Daemon struct {
+	Client *ts.TSClient
+	Watch  func(ctx context.Context) (Watcher, error)
+	Index  *Index
+	Logf   func(format string, args ...any)
+}
+
+// New returns a Daemon that watches the local tailscaled.
+func New(client *ts.TSClient, lc *local.Client) *Daemon {
+	return &Daemon{
+		Client: client,
+		Watch:  LocalWatch(lc),
+		Index:  NewIndex(),
+		Logf:   log.Printf,
+	}
+}
+
+// LocalWatch returns a function that watches the IPN bus of the local
+// tailscaled for netmap changes.
+func LocalWatch(lc *local.Client) func(ctx context.Context) (Watcher, error) {
+	return func(ctx context.Context) (Watcher, error) {
+		return lc.WatchIPNBus(ctx, ipn.NotifyInitialNetMap|ipn.NotifyNoPrivateKeys|ipn.NotifyRateLimit)
+	}
+}
+
+// Refresh rebuilds the index from the current tailnet status, including this
+// node so it can be looked up like any other.
+func (d *Daemon) Refresh(ctx context.Context) error {
+	hosts, err := d.Client.GetAllHosts(ctx, ts.PeerFilter{Self: true})
+	if err != nil {
+		return err
+	}
+	d.Index.Update(hosts)
+	d.Logf("indexed %d hosts", len(hosts))
+	return nil
+}
+
+// Run watches the IPN bus and refreshes the index on every netmap update
+// until the context is cancelled.
+func (d *Daemon) Run(ctx context.Context) error {
+	return WatchNetmap(ctx, d.Watch, d.Refresh, d.Logf)
+}
+
+// WatchNetmap calls update for the initial netmap and every change after it
+// until the context is cancelled. The IPN bus is watched again if it fails,
+// for example when tailscaled restarts.
+func WatchNetmap(ctx context.Context, watch func(ctx context.Context) (Watcher, error), update func(ctx context.Context) error, logf func(format string, args ...any)) error {
+	for {
+		err := watchNetmap(ctx, watch, update, logf)
+		if ctx.Err() != nil {
+			return nil
+		}
+		logf("watching IPN bus: %v", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+	}
+}
+
+func watchNetmap(ctx context.Context, watch func(ctx context.Context) (Watcher, error), update func(ctx context.Context) error, logf func(format string, args ...any)) error {
+	w, err := watch(ctx)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap == nil {
+			continue
+		}
+		if err := update(ctx); err != nil {
+			logf("updating from netmap: %v", err)
+		}
+	}
+}
+
+// Handler returns the HTTP handler for the socket API.
+func (d *Daemon) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /host", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		h, ok := d.Index.Lookup(name)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no Tailscale SSH host found for %s", name), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h) //nolint:errcheck
+	})
+	return mux
+}
+
+// Listen removes a stale socket and listens on the path.
+func Listen(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if _, err := Dial(path); err == nil {
+		return nil, fmt.Errorf("daemon already running on %s", path)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Serve serves the socket API until the context is cancelled.
+func (d *Daemon) Serve(ctx context.Context, l net.Listener) error {
+	srv := &http.Server{Handler: d.Handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close() //nolint:errcheck
+	}()
+	if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
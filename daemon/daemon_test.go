@@ -0,0 +1,158 @@
+package daemon
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"path/filepath"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/types/netmap"
+)
+
+var testHost = &ts.TailscaleHost{
+	Name: "test." + in.TEST_TAILNET + ".",
+	IPs:  []netip.Addr{in.TEST_IP, in.TEST_IP6},
+	Keys: []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+}
+
+func TestIndex(t *testing.T) {
+	shared := &ts.TailscaleHost{Name: "test.other.ts.net.", Shared: true}
+	dup1 := &ts.TailscaleHost{Name: "dup.example.ts.net."}
+	dup2 := &ts.TailscaleHost{Name: "dup.other.example.ts.net."}
+	i := NewIndex()
+	i.Update([]*ts.TailscaleHost{shared, testHost, dup1, dup2})
+
+	tests := []struct {
+		host     string
+		expected *ts.TailscaleHost
+	}{
+		{"test", testHost},
+		{"TEST.example.ts.net.", testHost},
+		{in.TEST_IP.String(), testHost},
+		{"fd7a:115c:a1e0:0::1", testHost},
+		{"test.other.ts.net", shared},
+		{"dup", nil},
+		{"missing", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			h, ok := i.Lookup(tt.host)
+			assert.Equal(t, tt.expected != nil, ok)
+			assert.Equal(t, tt.expected, h)
+		})
+	}
+}
+
+func TestServeAndDial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "daemon.sock")
+	_, err := Dial(path)
+	assert.Error(t, err, "Dial should fail when the daemon is not running")
+
+	d := &Daemon{Index: NewIndex(), Logf: t.Logf}
+	d.Index.Update([]*ts.TailscaleHost{testHost})
+	l, err := Listen(path)
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Serve(ctx, l) //nolint:errcheck
+
+	c, err := Dial(path)
+	require.NoError(t, err)
+	h, err := c.GetHost(context.TODO(), "test")
+	require.NoError(t, err)
+	assert.Equal(t, testHost.Name, h.Name)
+	assert.Equal(t, testHost.IPs, h.IPs)
+	assert.Equal(t, in.TEST_HOST_KEY_OBJECT.Marshal(), h.Keys[0].Marshal())
+
+	_, err = c.GetHost(context.TODO(), "missing")
+	assert.ErrorContains(t, err, "no Tailscale SSH host found")
+
+	fallback := &ts.TailscaleHost{Name: "missing." + in.TEST_TAILNET + "."}
+	connects := 0
+	c.Fallback = func() (ts.HostGetter, error) {
+		connects++
+		return getterFunc(func(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+			return fallback, nil
+		}), nil
+	}
+	for range 2 {
+		h, err = c.GetHost(context.TODO(), "missing")
+		require.NoError(t, err)
+		assert.Equal(t, fallback, h, "Misses should be looked up directly")
+	}
+	assert.Equal(t, 1, connects, "The fallback should only connect once")
+	h, err = c.GetHost(context.TODO(), "test")
+	require.NoError(t, err)
+	assert.Equal(t, testHost.Name, h.Name, "Indexed hosts should come from the daemon")
+
+	_, err = Listen(path)
+	assert.Error(t, err, "Listen should fail when the daemon is already running")
+}
+
+type getterFunc func(ctx context.Context, host string) (*ts.TailscaleHost, error)
+
+func (f getterFunc) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	return f(ctx, host)
+}
+
+type fakeWatcher struct {
+	notes []ipn.Notify
+}
+
+func (f *fakeWatcher) Next() (ipn.Notify, error) {
+	if len(f.notes) == 0 {
+		return ipn.Notify{}, errors.New("closed")
+	}
+	n := f.notes[0]
+	f.notes = f.notes[1:]
+	return n, nil
+}
+
+func (f *fakeWatcher) Close() error { return nil }
+
+func TestWatch(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("Status", mock.Anything).Return(&ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "self." + in.TEST_TAILNET + ".",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.103")},
+			SSH_HostKeys: []string{in.TEST_HOST_KEY},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      testHost.Name,
+				TailscaleIPs: testHost.IPs,
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+		},
+	}, nil).Once()
+
+	d := &Daemon{
+		Client: &ts.TSClient{Client: m, Tailnet: in.TEST_TAILNET},
+		Watch: func(ctx context.Context) (Watcher, error) {
+			return &fakeWatcher{notes: []ipn.Notify{{}, {NetMap: &netmap.NetworkMap{}}}}, nil
+		},
+		Index: NewIndex(),
+		Logf:  t.Logf,
+	}
+	err := watchNetmap(context.TODO(), d.Watch, d.Refresh, d.Logf)
+	assert.EqualError(t, err, "closed")
+	m.AssertExpectations(t)
+
+	h, ok := d.Index.Lookup("test")
+	require.True(t, ok)
+	assert.Equal(t, testHost.Name, h.Name)
+	h, ok = d.Index.Lookup("self")
+	require.True(t, ok, "This node should be indexed")
+	assert.Equal(t, "self."+in.TEST_TAILNET+".", h.Name)
+}
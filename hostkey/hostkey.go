@@ -0,0 +1,173 @@
+// Package hostkey provides SSH host key verification for Tailscale nodes for
+// use with golang.org/x/crypto/ssh clients.
+//
+//	v, err := hostkey.NewLocal()
+//	if err != nil {
+//		return err
+//	}
+//	algos, err := v.HostKeyAlgorithms(ctx, addr)
+//	if err != nil {
+//		return err
+//	}
+//	config := &ssh.ClientConfig{
+//		HostKeyCallback:   v.HostKeyCallback(),
+//		HostKeyAlgorithms: algos,
+//	}
+package hostkey
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"golang.org/x/crypto/ssh"
+	"tailscale.com/client/local"
+)
+
+// KeyMismatchError is returned when the key offered by the server does not
+// match any key advertised by the Tailscale node.
+type KeyMismatchError struct {
+	Host string
+	Key  ssh.PublicKey   // Key offered by the server
+	Want []ssh.PublicKey // Keys advertised by the node
+}
+
+func (e *KeyMismatchError) Error() string {
+	return "ssh: host key mismatch for " + e.Host
+}
+
+// NotTailnetError is returned when the host is not a node in the tailnet.
+type NotTailnetError struct {
+	Host string
+	Err  error
+}
+
+func (e *NotTailnetError) Error() string {
+	if e.Err != nil {
+		return "ssh: " + e.Host + " is not a Tailscale node: " + e.Err.Error()
+	}
+	return "ssh: " + e.Host + " is not a Tailscale node"
+}
+
+func (e *NotTailnetError) Unwrap() error {
+	return e.Err
+}
+
+// NoSSHError is returned when the node does not have Tailscale SSH enabled and
+// so advertises no host keys.
+type NoSSHError struct {
+	Host string
+	Err  error
+}
+
+func (e *NoSSHError) Error() string {
+	return "ssh: Tailscale SSH is not enabled for " + e.Host
+}
+
+func (e *NoSSHError) Unwrap() error {
+	return e.Err
+}
+
+// algorithmOrder is the preferred order of host key algorithms.
+var algorithmOrder = []string{ts.ED25519, ts.ECDSA, ts.RSA}
+
+// Verifier verifies SSH host keys against the keys advertised by Tailscale.
+type Verifier struct {
+	client ts.HostGetter
+}
+
+func New(client ts.HostGetter) *Verifier {
+	return &Verifier{client: client}
+}
+
+// NewLocal returns a Verifier that uses the local tailscaled.
+func NewLocal() (*Verifier, error) {
+	c, err := ts.NewTSClient(&local.Client{})
+	if err != nil {
+		return nil, err
+	}
+	return New(c), nil
+}
+
+// lookupHost returns the name to look up for a dialed address. The address
+// that was actually connected to is preferred over the dialed name.
+func lookupHost(hostname string, remote net.Addr) string {
+	if tcp, ok := remote.(*net.TCPAddr); ok && tcp != nil {
+		if ip, ok := netip.AddrFromSlice(tcp.IP); ok {
+			return ip.Unmap().String()
+		}
+	}
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return host
+	}
+	return strings.Trim(hostname, "[]")
+}
+
+// getHost looks up the host and converts lookup failures into the errors
+// exported by this package.
+func (v *Verifier) getHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	tsHost, err := v.client.GetHost(ctx, host)
+	var noSSH *ts.SSHNotEnabledError
+	var badName *ts.InvalideTailscaleNameError
+	var badIP *ts.InvalidTailscaleIPError
+	switch {
+	case errors.As(err, &noSSH):
+		return nil, &NoSSHError{Host: host, Err: err}
+	case errors.As(err, &badName), errors.As(err, &badIP):
+		return nil, &NotTailnetError{Host: host, Err: err}
+	case err != nil:
+		return nil, err
+	case tsHost == nil || len(tsHost.Keys) == 0:
+		return nil, &NoSSHError{Host: host}
+	}
+	return tsHost, nil
+}
+
+// HostKeyCallback returns an ssh.HostKeyCallback that only accepts keys
+// advertised by the Tailscale node. Any lookup failure rejects the key.
+func (v *Verifier) HostKeyCallback() ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host := lookupHost(hostname, remote)
+		tsHost, err := v.getHost(context.Background(), host)
+		if err != nil {
+			return err
+		}
+		var want []ssh.PublicKey
+		for _, algo := range algorithmOrder {
+			for _, k := range tsHost.KeysOfType(algo) {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return nil
+				}
+				want = append(want, k)
+			}
+		}
+		return &KeyMismatchError{Host: host, Key: key, Want: want}
+	}
+}
+
+// HostKeyAlgorithms returns the host key algorithms advertised by the node at
+// addr, in order of preference, for use in ssh.ClientConfig.
+func (v *Verifier) HostKeyAlgorithms(ctx context.Context, addr string) ([]string, error) {
+	host := lookupHost(addr, nil)
+	tsHost, err := v.getHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var algos []string
+	for _, algo := range algorithmOrder {
+		if len(tsHost.KeysOfType(algo)) == 0 {
+			continue
+		}
+		if algo == ts.RSA {
+			// RSA keys are used with SHA-2 signatures, ssh-rsa is kept for
+			// older servers.
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256)
+		}
+		algos = append(algos, algo)
+	}
+	return algos, nil
+}
@@ -0,0 +1,112 @@
+package hostkey
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/netip"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+type fakeGetter struct {
+	hosts map[string]*ts.TailscaleHost
+	errs  map[string]error
+}
+
+func (f *fakeGetter) GetHost(ctx context.Context, host string) (*ts.TailscaleHost, error) {
+	if err, ok := f.errs[host]; ok {
+		return nil, err
+	}
+	if h, ok := f.hosts[host]; ok {
+		return h, nil
+	}
+	return nil, fmt.Errorf("unknown host %s", host)
+}
+
+func newFakeGetter() *fakeGetter {
+	host := &ts.TailscaleHost{
+		Name: "test.example.ts.net.",
+		IPs:  []netip.Addr{in.TEST_IP},
+		Keys: []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+	}
+	return &fakeGetter{
+		hosts: map[string]*ts.TailscaleHost{
+			"test":              host,
+			in.TEST_IP.String(): host,
+		},
+		errs: map[string]error{
+			"nossh":       &ts.SSHNotEnabledError{Host: "nossh"},
+			"192.168.0.1": &ts.InvalidTailscaleIPError{IP: netip.MustParseAddr("192.168.0.1")},
+		},
+	}
+}
+
+func randomKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	cb := New(newFakeGetter()).HostKeyCallback()
+	remote := &net.TCPAddr{IP: net.IP(in.TEST_IP.AsSlice()), Port: 22}
+
+	t.Run("Match", func(t *testing.T) {
+		assert.NoError(t, cb("test:22", remote, in.TEST_HOST_KEY_OBJECT))
+		assert.NoError(t, cb("test:22", nil, in.TEST_HOST_KEY_OBJECT))
+	})
+
+	t.Run("Mismatch", func(t *testing.T) {
+		err := cb("test:22", remote, randomKey(t))
+		var mismatch *KeyMismatchError
+		require.ErrorAs(t, err, &mismatch)
+		assert.Equal(t, []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT}, mismatch.Want)
+	})
+
+	t.Run("Rotated key", func(t *testing.T) {
+		rotated := randomKey(t)
+		getter := newFakeGetter()
+		getter.hosts["test"].Keys = append(getter.hosts["test"].Keys, rotated)
+		cb := New(getter).HostKeyCallback()
+		assert.NoError(t, cb("test:22", nil, in.TEST_HOST_KEY_OBJECT))
+		assert.NoError(t, cb("test:22", nil, rotated), "Both keys of a rotation should be accepted")
+	})
+
+	t.Run("No SSH", func(t *testing.T) {
+		err := cb("nossh:22", nil, in.TEST_HOST_KEY_OBJECT)
+		var noSSH *NoSSHError
+		assert.ErrorAs(t, err, &noSSH)
+	})
+
+	t.Run("Not tailnet", func(t *testing.T) {
+		err := cb("192.168.0.1:22", nil, in.TEST_HOST_KEY_OBJECT)
+		var notTailnet *NotTailnetError
+		assert.ErrorAs(t, err, &notTailnet)
+	})
+
+	t.Run("Unknown host fails closed", func(t *testing.T) {
+		assert.Error(t, cb("missing:22", nil, in.TEST_HOST_KEY_OBJECT))
+	})
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	v := New(newFakeGetter())
+
+	algos, err := v.HostKeyAlgorithms(context.TODO(), "test:22")
+	require.NoError(t, err)
+	assert.Equal(t, []string{ts.ED25519}, algos)
+
+	_, err = v.HostKeyAlgorithms(context.TODO(), "nossh:22")
+	var noSSH *NoSSHError
+	assert.ErrorAs(t, err, &noSSH)
+}
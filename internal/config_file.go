@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// backupTimeFormat sorts lexically in time order
+const backupTimeFormat = "20060102T150405.000000000Z"
+
+// maxSymlinks is the number of symlinks followed before giving up on a loop
+const maxSymlinks = 40
+
+var backupNow = time.Now
+
+// ResolveSymlinks returns the path of the file that path points to, so a
+// symlinked config is written in place instead of being replaced by a
+// regular file. Paths that don't exist are returned unchanged.
+func ResolveSymlinks(fs afero.Fs, path string) (string, error) {
+	lstater, ok := fs.(afero.Lstater)
+	if !ok {
+		return path, nil
+	}
+	reader, ok := fs.(afero.LinkReader)
+	if !ok {
+		return path, nil
+	}
+	for range maxSymlinks {
+		fi, _, err := lstater.LstatIfPossible(path)
+		if os.IsNotExist(err) {
+			return path, nil
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return path, nil
+		}
+		target, err := reader.ReadlinkIfPossible(path)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		path = target
+	}
+	return "", fmt.Errorf("Error resolving %s: too many levels of symbolic links", path)
+}
+
+// backupPrefix returns the prefix of the backups of path. Backups are hidden
+// so an "Include config.d/*" doesn't pick them up.
+func backupPrefix(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tailshale-")
+}
+
+// Backups returns the backups of the file at path, oldest first.
+func Backups(fs afero.Fs, path string) ([]string, error) {
+	path, err := ResolveSymlinks(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := afero.ReadDir(fs, filepath.Dir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prefix := backupPrefix(path)
+	backups := []string{}
+	for _, entry := range entries {
+		name := filepath.Join(filepath.Dir(path), entry.Name())
+		if entry.Mode().IsRegular() && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ".bak") {
+			backups = append(backups, name)
+		}
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// BackupFile copies the file at path to a timestamped backup next to it,
+// removing the oldest backups so only keep are left. It does nothing if keep
+// is zero or the file doesn't exist.
+func BackupFile(fs afero.Fs, path string, keep int) error {
+	return backupFile(fs, path, backupNow().UTC().Format(backupTimeFormat), keep)
+}
+
+// BackupFiles backs up the files at paths as a set, giving every backup the
+// same timestamp so RestoreConfigFiles can put them back together. A file
+// without a backup at that timestamp didn't exist.
+func BackupFiles(fs afero.Fs, paths []string, keep int) error {
+	stamp := backupNow().UTC().Format(backupTimeFormat)
+	for _, path := range paths {
+		if err := backupFile(fs, path, stamp, keep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupFile copies the file at path to the backup with the timestamp stamp
+func backupFile(fs afero.Fs, path, stamp string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	path, err := ResolveSymlinks(fs, path)
+	if err != nil {
+		return err
+	}
+	content, err := afero.ReadFile(fs, path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	backup := backupPrefix(path) + stamp + ".bak"
+	if err := writeAtomic(fs, backup, content, 0600, nil); err != nil {
+		return fmt.Errorf("Error backing up %s: %w", path, err)
+	}
+	backups, err := Backups(fs, path)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := fs.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Error removing old backup: %w", err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// WriteConfigFile atomically replaces the file at path with content, backing
+// up the current file first. The content is written to a temporary file in
+// the same directory, synced and renamed into place, so a crash or a full
+// disk never leaves a partly written file. Symlinks are followed and the
+// mode and ownership of an existing file are kept.
+func WriteConfigFile(fs afero.Fs, path string, content []byte, keep int) error {
+	path, err := ResolveSymlinks(fs, path)
+	if err != nil {
+		return err
+	}
+	perm := os.FileMode(0600)
+	fi, err := fs.Stat(path)
+	if err == nil {
+		perm = fi.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := BackupFile(fs, path, keep); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Error creating directory: %w", err)
+	}
+	return writeAtomic(fs, path, content, perm, fi)
+}
+
+// RemoveConfigFile backs up and removes the file at path.
+func RemoveConfigFile(fs afero.Fs, path string, keep int) error {
+	if err := BackupFile(fs, path, keep); err != nil {
+		return err
+	}
+	if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Error removing %s: %w", path, err)
+	}
+	return nil
+}
+
+// RestoreConfigFiles puts the files at paths back to their most recent set
+// of backups made by BackupFiles. Files without a backup in that set didn't
+// exist then and are removed. The backup used for each path is returned, or
+// an empty string if it was removed, and nil if there are no backups at all.
+// The current files are backed up first, so a restore can itself be undone.
+func RestoreConfigFiles(fs afero.Fs, paths []string, keep int) (map[string]string, error) {
+	latest := ""
+	found := map[string]string{}
+	for _, path := range paths {
+		backups, err := Backups(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		if len(backups) == 0 {
+			continue
+		}
+		resolved, err := ResolveSymlinks(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		backup := backups[len(backups)-1]
+		found[path] = backup
+		stamp := strings.TrimSuffix(strings.TrimPrefix(backup, backupPrefix(resolved)), ".bak")
+		latest = max(latest, stamp)
+	}
+	if latest == "" {
+		return nil, nil
+	}
+
+	restore := map[string][]byte{}
+	for _, path := range paths {
+		backup := found[path]
+		if backup == "" || !strings.HasSuffix(backup, latest+".bak") {
+			found[path] = ""
+			continue
+		}
+		content, err := afero.ReadFile(fs, backup)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading backup %s: %w", backup, err)
+		}
+		restore[path] = content
+	}
+	if err := BackupFiles(fs, paths, keep); err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		content, ok := restore[path]
+		if !ok {
+			if err := RemoveConfigFile(fs, path, 0); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := WriteConfigFile(fs, path, content, 0); err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
+
+// WriteFileAtomic atomically replaces the file at path with content, creating
+// its directory if needed. The content is written to a temporary file in the
+// same directory, synced and renamed into place, so readers never see a
+// partly written file.
+func WriteFileAtomic(fs afero.Fs, path string, content []byte, perm os.FileMode) error {
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Error creating directory: %w", err)
+	}
+	return writeAtomic(fs, path, content, perm, nil)
+}
+
+// writeAtomic writes content to a temporary file next to path and renames it
+// into place. If owner isn't nil the file is given the same owner.
+func writeAtomic(fs afero.Fs, path string, content []byte, perm os.FileMode, owner os.FileInfo) error {
+	dir := filepath.Dir(path)
+	tmp, err := afero.TempFile(fs, dir, "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("Error creating temporary file: %w", err)
+	}
+	// Clean up the temporary file if anything fails before the rename
+	defer fs.Remove(tmp.Name()) //nolint:errcheck
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error syncing temporary file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing temporary file: %w", err)
+	}
+	if err := fs.Chmod(tmp.Name(), perm); err != nil {
+		return fmt.Errorf("Error setting file mode: %w", err)
+	}
+	if owner != nil {
+		if err := copyOwner(fs, tmp.Name(), owner); err != nil {
+			return fmt.Errorf("Error setting file owner: %w", err)
+		}
+	}
+	if err := fs.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error replacing %s: %w", path, err)
+	}
+	return nil
+}
+
+// LockConfigFile takes an advisory lock on the file at path, so concurrent
+// runs don't overwrite each other's changes. The lock is held on a hidden
+// file next to it until the returned function is called.
+func LockConfigFile(fs afero.Fs, path string) (func() error, error) {
+	path, err := ResolveSymlinks(fs, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("Error creating directory: %w", err)
+	}
+	lockPath := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tailshale.lock")
+	f, err := fs.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening lock file: %w", err)
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error locking %s: %w", path, err)
+	}
+	return func() error {
+		unlockFile(f) //nolint:errcheck
+		return f.Close()
+	}, nil
+}
@@ -0,0 +1,23 @@
+//go:build !unix
+
+package internal
+
+import (
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// copyOwner is a no-op where files don't have Unix owners
+func copyOwner(fs afero.Fs, path string, fi os.FileInfo) error {
+	return nil
+}
+
+// lockFile is a no-op where advisory locks aren't supported
+func lockFile(f afero.File) error {
+	return nil
+}
+
+func unlockFile(f afero.File) error {
+	return nil
+}
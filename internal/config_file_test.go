@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock steps backupNow forward a second on each call
+func fakeClock(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	backupNow = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	t.Cleanup(func() { backupNow = time.Now })
+}
+
+func TestWriteConfigFile(t *testing.T) {
+	fakeClock(t)
+	fs := afero.NewMemMapFs()
+	path := "/home/user/.ssh/config"
+
+	require.NoError(t, WriteConfigFile(fs, path, []byte("one\n"), 2))
+	fi, err := fs.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm(), "New files should only be readable by the user")
+	backups, err := Backups(fs, path)
+	require.NoError(t, err)
+	assert.Empty(t, backups, "A new file has nothing to back up")
+
+	require.NoError(t, fs.Chmod(path, 0644))
+	for _, content := range []string{"two\n", "three\n", "four\n"} {
+		require.NoError(t, WriteConfigFile(fs, path, []byte(content), 2))
+	}
+	content, _ := afero.ReadFile(fs, path)
+	assert.Equal(t, "four\n", string(content))
+	fi, _ = fs.Stat(path)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm(), "The mode should be kept")
+
+	backups, err = Backups(fs, path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"/home/user/.ssh/.config.tailshale-20250102T030408.000000000Z.bak",
+		"/home/user/.ssh/.config.tailshale-20250102T030409.000000000Z.bak",
+	}, backups, "Only the newest backups should be kept")
+	content, _ = afero.ReadFile(fs, backups[1])
+	assert.Equal(t, "three\n", string(content))
+
+	entries, _ := afero.ReadDir(fs, "/home/user/.ssh")
+	assert.Len(t, entries, 3, "No temporary files should be left behind")
+
+	t.Run("Restore", func(t *testing.T) {
+		restored, err := RestoreConfigFiles(fs, []string{path}, 2)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{path: backups[1]}, restored)
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, "three\n", string(content))
+
+		_, err = RestoreConfigFiles(fs, []string{path}, 2)
+		require.NoError(t, err)
+		content, _ = afero.ReadFile(fs, path)
+		assert.Equal(t, "four\n", string(content), "Restoring again should undo the restore")
+	})
+
+	t.Run("Remove", func(t *testing.T) {
+		require.NoError(t, RemoveConfigFile(fs, path, 2))
+		exists, _ := afero.Exists(fs, path)
+		assert.False(t, exists)
+		_, err := RestoreConfigFiles(fs, []string{path}, 2)
+		require.NoError(t, err)
+		content, _ := afero.ReadFile(fs, path)
+		assert.Equal(t, "four\n", string(content), "A removed file should be restorable")
+	})
+
+	t.Run("No backups", func(t *testing.T) {
+		restored, err := RestoreConfigFiles(fs, []string{"/home/user/.ssh/other"}, 2)
+		require.NoError(t, err)
+		assert.Nil(t, restored)
+	})
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	path := "/home/user/.cache/tailshale/hosts.json"
+
+	require.NoError(t, WriteFileAtomic(fs, path, []byte("one\n"), 0600), "Missing directories should be created")
+	require.NoError(t, WriteFileAtomic(fs, path, []byte("two\n"), 0644))
+	content, _ := afero.ReadFile(fs, path)
+	assert.Equal(t, "two\n", string(content))
+	fi, err := fs.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm())
+
+	entries, _ := afero.ReadDir(fs, filepath.Dir(path))
+	assert.Len(t, entries, 1, "No temporary files should be left behind")
+}
+
+func TestRestoreConfigFiles(t *testing.T) {
+	fakeClock(t)
+	fs := afero.NewMemMapFs()
+	config := "/home/user/.ssh/config"
+	include := "/home/user/.ssh/config.d/tailshale.conf"
+	paths := []string{config, include}
+	afero.WriteFile(fs, config, []byte("inline\n"), 0600)
+
+	// Switch to an include file, then change only the include file
+	require.NoError(t, BackupFiles(fs, paths, 5))
+	require.NoError(t, WriteConfigFile(fs, config, []byte("Include\n"), 0))
+	require.NoError(t, WriteConfigFile(fs, include, []byte("one\n"), 0))
+	require.NoError(t, BackupFiles(fs, paths, 5))
+	require.NoError(t, WriteConfigFile(fs, include, []byte("two\n"), 0))
+
+	restored, err := RestoreConfigFiles(fs, paths, 5)
+	require.NoError(t, err)
+	assert.Len(t, restored, 2)
+	content, _ := afero.ReadFile(fs, config)
+	assert.Equal(t, "Include\n", string(content), "The config should come from the same set as the include file")
+	content, _ = afero.ReadFile(fs, include)
+	assert.Equal(t, "one\n", string(content))
+
+	// Restoring again undoes the restore
+	_, err = RestoreConfigFiles(fs, paths, 5)
+	require.NoError(t, err)
+	content, _ = afero.ReadFile(fs, include)
+	assert.Equal(t, "two\n", string(content))
+
+	t.Run("Missing from the set", func(t *testing.T) {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, config, []byte("inline\n"), 0600)
+		require.NoError(t, BackupFiles(fs, paths, 5))
+		require.NoError(t, WriteConfigFile(fs, config, []byte("Include\n"), 0))
+		require.NoError(t, WriteConfigFile(fs, include, []byte("one\n"), 0))
+
+		restored, err := RestoreConfigFiles(fs, paths, 5)
+		require.NoError(t, err)
+		assert.Empty(t, restored[include], "The include file didn't exist in the set")
+		content, _ := afero.ReadFile(fs, config)
+		assert.Equal(t, "inline\n", string(content))
+		exists, _ := afero.Exists(fs, include)
+		assert.False(t, exists, "A file without a backup in the set should be removed")
+	})
+}
+
+func TestWriteConfigFile_Symlink(t *testing.T) {
+	fs := afero.NewOsFs()
+	dir := t.TempDir()
+	target := filepath.Join(dir, "dotfiles", "ssh_config")
+	link := filepath.Join(dir, "config")
+	require.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+	require.NoError(t, os.WriteFile(target, []byte("old\n"), 0640))
+	require.NoError(t, os.Symlink(filepath.Join("dotfiles", "ssh_config"), link))
+
+	resolved, err := ResolveSymlinks(fs, link)
+	require.NoError(t, err)
+	assert.Equal(t, target, resolved)
+
+	require.NoError(t, WriteConfigFile(fs, link, []byte("new\n"), 1))
+	fi, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeSymlink, "The symlink should be kept")
+	content, _ := os.ReadFile(target)
+	assert.Equal(t, "new\n", string(content), "The target should be written")
+	fi, _ = os.Stat(target)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+
+	backups, err := Backups(fs, link)
+	require.NoError(t, err)
+	require.Len(t, backups, 1)
+	assert.Equal(t, filepath.Dir(target), filepath.Dir(backups[0]), "Backups should be kept next to the target")
+}
+
+func TestLockConfigFile(t *testing.T) {
+	fs := afero.NewOsFs()
+	path := filepath.Join(t.TempDir(), "ssh", "config")
+
+	unlock, err := LockConfigFile(fs, path)
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := LockConfigFile(fs, path)
+		if err == nil {
+			unlock() //nolint:errcheck
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("The lock should be held until it is released")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, unlock())
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The lock should be acquired once released")
+	}
+}
@@ -0,0 +1,47 @@
+//go:build unix
+
+package internal
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/spf13/afero"
+)
+
+// copyOwner gives the file at path the owner of fi. It does nothing if the
+// owner is already the same, so unprivileged users can still write their own
+// files.
+func copyOwner(fs afero.Fs, path string, fi os.FileInfo) error {
+	want, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	current, err := fs.Stat(path)
+	if err != nil {
+		return err
+	}
+	if have, ok := current.Sys().(*syscall.Stat_t); ok && have.Uid == want.Uid && have.Gid == want.Gid {
+		return nil
+	}
+	return fs.Chown(path, int(want.Uid), int(want.Gid))
+}
+
+// lockFile takes an exclusive advisory lock on the file, waiting for any
+// other holder to release it. Files that aren't on disk can't be locked and
+// are ignored.
+func lockFile(f afero.File) error {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	return syscall.Flock(int(osFile.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f afero.File) error {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	return syscall.Flock(int(osFile.Fd()), syscall.LOCK_UN)
+}
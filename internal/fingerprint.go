@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Randomart field dimensions, matching OpenSSH
+const (
+	fldBase  = 8
+	fldSizeY = fldBase + 1
+	fldSizeX = fldBase*2 + 1
+)
+
+// augmentationString holds the randomart symbols, from least to most
+// visited. The last two are the start and end positions.
+const augmentationString = " .o+=*BOX@%&#/^SE"
+
+// KeyTypeName returns the short key type name used by ssh-keygen, such as
+// ED25519, ECDSA or RSA.
+func KeyTypeName(key ssh.PublicKey) string {
+	switch key.Type() {
+	case ssh.KeyAlgoED25519:
+		return "ED25519"
+	case ssh.KeyAlgoRSA:
+		return "RSA"
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return "ECDSA"
+	default:
+		return strings.ToUpper(key.Type())
+	}
+}
+
+// KeyBits returns the size of the key in bits, or 0 if it is unknown.
+func KeyBits(key ssh.PublicKey) int {
+	if key.Type() == ssh.KeyAlgoED25519 {
+		return 256
+	}
+	ck, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := ck.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	default:
+		return 0
+	}
+}
+
+// FingerprintMD5 returns the legacy MD5 fingerprint of the key in the format
+// printed by ssh-keygen -E md5.
+func FingerprintMD5(key ssh.PublicKey) string {
+	return "MD5:" + ssh.FingerprintLegacyMD5(key)
+}
+
+// Randomart returns the OpenSSH visual host key for the SHA256 fingerprint
+// of the key, as printed by ssh-keygen -lv.
+func Randomart(key ssh.PublicKey) string {
+	digest := sha256.Sum256(key.Marshal())
+	symbols := len(augmentationString) - 1
+
+	// Walk the drunken bishop from the centre of the field, two bits of the
+	// digest per move
+	var field [fldSizeX][fldSizeY]int
+	x, y := fldSizeX/2, fldSizeY/2
+	for _, input := range digest {
+		for range 4 {
+			if input&0x1 != 0 {
+				x++
+			} else {
+				x--
+			}
+			if input&0x2 != 0 {
+				y++
+			} else {
+				y--
+			}
+			x = min(max(x, 0), fldSizeX-1)
+			y = min(max(y, 0), fldSizeY-1)
+			if field[x][y] < symbols-2 {
+				field[x][y]++
+			}
+			input >>= 2
+		}
+	}
+	field[fldSizeX/2][fldSizeY/2] = symbols - 1
+	field[x][y] = symbols
+
+	title := fmt.Sprintf("[%s %d]", KeyTypeName(key), KeyBits(key))
+	if len(title) > fldSizeX {
+		title = fmt.Sprintf("[%s]", KeyTypeName(key))
+	}
+
+	var b strings.Builder
+	b.WriteString(randomartBorder(title))
+	b.WriteByte('\n')
+	for y := range fldSizeY {
+		b.WriteByte('|')
+		for x := range fldSizeX {
+			b.WriteByte(augmentationString[min(field[x][y], symbols)])
+		}
+		b.WriteString("|\n")
+	}
+	b.WriteString(randomartBorder("[SHA256]"))
+	return b.String()
+}
+
+// randomartBorder returns a randomart border with the label centred in it.
+func randomartBorder(label string) string {
+	left := (fldSizeX - len(label)) / 2
+	return "+" + strings.Repeat("-", left) + label + strings.Repeat("-", fldSizeX-left-len(label)) + "+"
+}
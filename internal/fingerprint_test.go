@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyTypeNameAndBits(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+
+	assert.Equal(t, "ED25519", KeyTypeName(TEST_HOST_KEY_OBJECT))
+	assert.Equal(t, 256, KeyBits(TEST_HOST_KEY_OBJECT))
+	assert.Equal(t, "RSA", KeyTypeName(rsaKey))
+	assert.Equal(t, 1024, KeyBits(rsaKey))
+}
+
+func TestFingerprintMD5(t *testing.T) {
+	assert.Equal(t, "MD5:48:0d:cf:76:3d:8d:01:85:70:c4:d8:68:94:a5:bb:4d", FingerprintMD5(TEST_HOST_KEY_OBJECT))
+}
+
+func TestRandomart(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+
+	// Expected output from ssh-keygen -lv
+	assert.Equal(t, strings.Join([]string{
+		"+--[ED25519 256]--+",
+		"|           .= =.+|",
+		"|       . . = B Oo|",
+		"|        + = E O.o|",
+		"|         = + o.=o|",
+		"|        S + . =.o|",
+		"|     . o + + o . |",
+		"|      + . * . .  |",
+		"|  .. ... o . . . |",
+		"|  .oo...    ..o  |",
+		"+----[SHA256]-----+",
+	}, "\n"), Randomart(TEST_HOST_KEY_OBJECT))
+	assert.Equal(t, strings.Join([]string{
+		"+---[RSA 1024]----+",
+		"| .o++o o.. +.    |",
+		"| oo.=.o . + .    |",
+		"|  .o + . . .     |",
+		"|    * .   .      |",
+		"|   o.+  S  .     |",
+		"|  .  o.+ o.      |",
+		"| .    = +o.      |",
+		"|.    o B=...     |",
+		"|Eo.  o%Boooo.    |",
+		"+----[SHA256]-----+",
+	}, "\n"), Randomart(rsaKey))
+}
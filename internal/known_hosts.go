@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KnownHostsEntry is a single line of a known_hosts file. Lines that are not
+// host entries, such as comments, have a nil Key.
+type KnownHostsEntry struct {
+	Line   string
+	Marker string
+	Hosts  []string
+	Key    ssh.PublicKey
+}
+
+// ParseKnownHosts splits the content of a known_hosts file into entries, one
+// per line, so that it can be written back unchanged.
+func ParseKnownHosts(content string) []KnownHostsEntry {
+	var entries []KnownHostsEntry
+	for _, line := range strings.SplitAfter(content, "\n") {
+		if line == "" {
+			continue
+		}
+		entry := KnownHostsEntry{Line: line}
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			marker, hosts, key, _, _, err := ssh.ParseKnownHosts([]byte(trimmed))
+			if err == nil {
+				entry.Marker = marker
+				entry.Hosts = hosts
+				entry.Key = key
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// RemoveKnownHostsPatterns returns the entry's line without the given host
+// patterns, keeping the rest of the line as it was.
+func RemoveKnownHostsPatterns(entry KnownHostsEntry, patterns []string) string {
+	line := entry.Line
+	start := len(line) - len(strings.TrimLeft(line, " \t"))
+	if entry.Marker != "" {
+		// Skip the marker, which is parsed without its @
+		start += strings.IndexAny(line[start:], " \t")
+		start += len(line[start:]) - len(strings.TrimLeft(line[start:], " \t"))
+	}
+	end := start + strings.IndexAny(line[start:], " \t")
+	kept := slices.DeleteFunc(slices.Clone(entry.Hosts), func(host string) bool {
+		return slices.Contains(patterns, host)
+	})
+	return line[:start] + strings.Join(kept, ",") + line[end:]
+}
+
+// SplitKnownHostsPattern returns the host and port of a known_hosts host
+// pattern. The port is empty for the default port.
+func SplitKnownHostsPattern(pattern string) (string, string) {
+	if strings.HasPrefix(pattern, "[") {
+		if host, port, err := net.SplitHostPort(pattern); err == nil {
+			return host, port
+		}
+		return strings.Trim(pattern, "[]"), ""
+	}
+	return pattern, ""
+}
+
+// hashHost returns the HMAC-SHA1 of the host with the salt, as used by
+// OpenSSH HashKnownHosts
+func hashHost(salt []byte, host string) []byte {
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return mac.Sum(nil)
+}
+
+// HashHostname hashes the host pattern in the |1|salt|hash format. The salt
+// is derived from the host and the key, so an entry always hashes the same
+// and files are only rewritten when their entries change. Unlike
+// knownhosts.HashHostname the pattern is hashed as is, so IPv6 addresses on
+// the default port are not bracketed and match what OpenSSH looks up.
+func HashHostname(host string, key ssh.PublicKey) string {
+	mac := hmac.New(sha1.New, key.Marshal())
+	mac.Write([]byte(host))
+	salt := mac.Sum(nil)
+	return "|1|" + base64.StdEncoding.EncodeToString(salt) + "|" + base64.StdEncoding.EncodeToString(hashHost(salt, host))
+}
+
+// IsWildcardPattern reports whether the known_hosts pattern uses wildcards or
+// negation, which can't be hashed.
+func IsWildcardPattern(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?!")
+}
+
+// MatchHashedHost reports whether a hashed known_hosts pattern in the
+// |1|salt|hash format matches the host.
+func MatchHashedHost(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "1" {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(hashHost(salt, host), want)
+}
@@ -0,0 +1,85 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestParseKnownHosts(t *testing.T) {
+	content := strings.Join([]string{
+		"# comment",
+		"",
+		"100.100.100.100,test " + TEST_HOST_KEY,
+		"@revoked * " + TEST_HOST_KEY,
+		"garbage",
+		"[test]:2222 " + TEST_HOST_KEY,
+	}, "\n")
+
+	entries := ParseKnownHosts(content)
+	require.Len(t, entries, 6)
+	assert.Equal(t, content, func() string {
+		var lines []string
+		for _, e := range entries {
+			lines = append(lines, e.Line)
+		}
+		return strings.Join(lines, "")
+	}(), "Entries should preserve the original content")
+
+	assert.Nil(t, entries[0].Key)
+	assert.Nil(t, entries[1].Key)
+	assert.Equal(t, []string{"100.100.100.100", "test"}, entries[2].Hosts)
+	assert.Equal(t, TEST_HOST_KEY_OBJECT.Marshal(), entries[2].Key.Marshal())
+	assert.Equal(t, "revoked", entries[3].Marker)
+	assert.Nil(t, entries[4].Key)
+	assert.Equal(t, []string{"[test]:2222"}, entries[5].Hosts)
+}
+
+func TestSplitKnownHostsPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host, port string
+	}{
+		{"test", "test", ""},
+		{"[test]:2222", "test", "2222"},
+		{"fd7a:115c:a1e0::1", "fd7a:115c:a1e0::1", ""},
+		{"[fd7a:115c:a1e0::1]:22", "fd7a:115c:a1e0::1", "22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			host, port := SplitKnownHostsPattern(tt.pattern)
+			assert.Equal(t, tt.host, host)
+			assert.Equal(t, tt.port, port)
+		})
+	}
+}
+
+func TestMatchHashedHost(t *testing.T) {
+	hashed := knownhosts.HashHostname("100.100.100.100")
+	assert.True(t, MatchHashedHost(hashed, "100.100.100.100"))
+	assert.False(t, MatchHashedHost(hashed, "100.100.100.101"))
+	assert.False(t, MatchHashedHost("100.100.100.100", "100.100.100.100"))
+}
+
+func TestHashHostname(t *testing.T) {
+	key2, _, _, _, err := ssh.ParseAuthorizedKey([]byte(TEST_HOST_KEY_2))
+	require.NoError(t, err)
+	for _, host := range []string{"test", "fd7a:115c:a1e0::1", "[test]:2222"} {
+		hashed := HashHostname(host, TEST_HOST_KEY_OBJECT)
+		assert.True(t, strings.HasPrefix(hashed, "|1|"))
+		assert.True(t, MatchHashedHost(hashed, host), "Hash should match %s", host)
+		assert.Equal(t, hashed, HashHostname(host, TEST_HOST_KEY_OBJECT), "The same entry should hash the same")
+		assert.NotEqual(t, hashed, HashHostname(host, key2), "Each key should have its own salt")
+	}
+	assert.NotEqual(t, HashHostname("a", TEST_HOST_KEY_OBJECT)[:32], HashHostname("b", TEST_HOST_KEY_OBJECT)[:32], "Each host should have its own salt")
+}
+
+func TestRemoveKnownHostsPatterns(t *testing.T) {
+	entries := ParseKnownHosts("  a,b,c " + TEST_HOST_KEY + "\n@revoked\tb,c " + TEST_HOST_KEY + "\n")
+	require.Len(t, entries, 2)
+	assert.Equal(t, "  a,c "+TEST_HOST_KEY+"\n", RemoveKnownHostsPatterns(entries[0], []string{"b"}))
+	assert.Equal(t, "@revoked\tc "+TEST_HOST_KEY+"\n", RemoveKnownHostsPatterns(entries[1], []string{"b"}))
+}
@@ -1,13 +1,14 @@
 package internal
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"path"
 	"slices"
 	"strings"
 
 	"github.com/lithammer/dedent"
-	"github.com/spf13/afero"
 )
 
 const (
@@ -23,31 +24,97 @@ var Cfg = dedent.Dedent(`
 # Do not edit manually. No really
 
 Match exec "%s known-hosts --check %%h"
-	KnownHostsCommand %s known-hosts %%h
+	KnownHostsCommand %s known-hosts --port=%%p --key-type=%%t %%H
+`)
+
+// CfgStatic points the SSH client at a known_hosts file maintained by
+// tailshale sync, for clients that do not support KnownHostsCommand.
+var CfgStatic = dedent.Dedent(`
+# Tailshale SSH configuration
+# Do not edit manually. No really
+
+Host *
+	UserKnownHostsFile ~/.ssh/known_hosts ~/.ssh/known_hosts2 %s
 `)
 
 type cfgLocation int
 
+// ErrMalformedConfig is returned when the tailshale block in an SSH config
+// can't be found safely, so rewriting the file could lose the user's config.
+var ErrMalformedConfig = errors.New("malformed tailshale block")
+
 type SSHConfig struct {
 	Beginning string
 	Config    string
 	End       string
+	// Newline is the line ending used for the tailshale block, "\r\n" for
+	// files with Windows line endings. Lines outside the block keep their own.
+	Newline string
+	// NoFinalNewline is set if the file doesn't end with a newline
+	NoFinalNewline bool
 }
 
-func NewSSHConfigFromFile(file afero.File) (*SSHConfig, error) {
-	// read the file in lines using a Scanner
-	scanner := bufio.NewScanner(file)
+// isMarker reports whether the line is the marker, ignoring surrounding
+// whitespace and a carriage return
+func isMarker(line, marker string) bool {
+	return strings.TrimSpace(line) == marker
+}
+
+// NewSSHConfigFromFile splits an SSH config into the tailshale block and the
+// user's config around it. It returns an ErrMalformedConfig error if a marker
+// is missing or there is more than one block.
+func NewSSHConfigFromFile(file io.Reader) (*SSHConfig, error) {
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading SSH config file: %w", err)
+	}
+	text := string(content)
+	cfg := &SSHConfig{Newline: "\n"}
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		cfg.NoFinalNewline = true
+	}
+	text = strings.TrimSuffix(text, "\n")
+	var lines []string
+	if text != "" || cfg.NoFinalNewline {
+		lines = strings.Split(text, "\n")
+	}
+	if len(lines) > 0 && strings.HasSuffix(lines[0], "\r") {
+		cfg.Newline = "\r\n"
+	}
+	// The last line of a CRLF file without a final newline has no carriage
+	// return. Give it one so content joined after it keeps the line ending,
+	// String takes it off again.
+	if n := len(lines); cfg.NoFinalNewline && n > 1 && strings.HasSuffix(lines[n-2], "\r") && !strings.HasSuffix(lines[n-1], "\r") {
+		lines[n-1] += "\r"
+	}
+
 	var configLines []string
 	var beginningLines []string
 	var endLines []string
 	l := cfgLocationBeginning
-	for scanner.Scan() {
-		line := scanner.Text()
-		if line == CfgStart {
+	startLine := 0
+	for i, line := range lines {
+		n := i + 1
+		if isMarker(line, CfgStart) {
+			switch l {
+			case cfgLocationConfig:
+				return nil, fmt.Errorf("%w: start marker on line %d has no end marker before line %d", ErrMalformedConfig, startLine, n)
+			case cfgLocationEnd:
+				return nil, fmt.Errorf("%w: duplicate block on line %d, the first starts on line %d", ErrMalformedConfig, n, startLine)
+			}
+			// An existing block keeps its own line endings
+			cfg.Newline = "\n"
+			if strings.HasSuffix(line, "\r") {
+				cfg.Newline = "\r\n"
+			}
 			l = cfgLocationConfig
+			startLine = n
 			continue
 		}
-		if line == CfgEnd {
+		if isMarker(line, CfgEnd) {
+			if l != cfgLocationConfig {
+				return nil, fmt.Errorf("%w: end marker on line %d has no start marker", ErrMalformedConfig, n)
+			}
 			l = cfgLocationEnd
 			continue
 		}
@@ -57,38 +124,61 @@ func NewSSHConfigFromFile(file afero.File) (*SSHConfig, error) {
 		case cfgLocationEnd:
 			endLines = append(endLines, line)
 		case cfgLocationConfig:
-			configLines = append(configLines, line)
+			configLines = append(configLines, strings.TrimSuffix(line, "\r"))
 		}
 	}
-
-	if err := scanner.Err(); err != nil {
-		// Handle the error, e.g., log it or return it
-		return nil, fmt.Errorf("error reading SSH config file: %w", err)
+	// Without an end marker everything after the start marker would be
+	// treated as tailshale config and deleted on the next write
+	if l == cfgLocationConfig {
+		return nil, fmt.Errorf("%w: start marker on line %d has no end marker", ErrMalformedConfig, startLine)
 	}
 
-	// Create a new SSHConfig instance
-	return &SSHConfig{
-		Beginning: strings.Join(beginningLines, "\n"),
-		End:       strings.Join(endLines, "\n"),
-		Config:    strings.Join(configLines, "\n"),
-	}, nil
+	cfg.Beginning = strings.Join(beginningLines, "\n")
+	cfg.End = strings.Join(endLines, "\n")
+	cfg.Config = strings.Join(configLines, "\n")
+	return cfg, nil
+}
+
+// cr returns the carriage return to end the block's lines with, if any
+func (c SSHConfig) cr() string {
+	if c.Newline == "\r\n" {
+		return "\r"
+	}
+	return ""
 }
 
 // Implement Stringer inteface
 func (c SSHConfig) String() string {
-	cfgParts := []string{
-		c.Beginning,
+	cr := c.cr()
+	var cfgParts []string
+	// An empty beginning would leave a blank line at the top of the file
+	if c.Beginning != "" {
+		cfgParts = append(cfgParts, c.Beginning)
 	}
 	if c.Config != "" {
+		config := c.Config
+		if cr != "" {
+			config = strings.Join(strings.Split(config, "\n"), cr+"\n") + cr
+		}
 		cfgParts = slices.Concat(cfgParts, []string{
-			CfgStart,
-			c.Config,
-			CfgEnd,
+			CfgStart + cr,
+			config,
+			CfgEnd + cr,
 		})
 	}
 	cfgParts = append(cfgParts, c.End)
 
-	return strings.Join(cfgParts, "\n")
+	s := strings.Join(cfgParts, "\n")
+	if c.NoFinalNewline {
+		if trimmed, ok := strings.CutSuffix(s, "\n"); ok {
+			return strings.TrimSuffix(trimmed, "\r")
+		}
+		return s
+	}
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	return s
 }
 
 var _ fmt.Stringer = SSHConfig{}
@@ -97,3 +187,271 @@ var _ fmt.Stringer = SSHConfig{}
 func (c *SSHConfig) SetConfig(exePath string) {
 	c.Config = fmt.Sprintf(Cfg, exePath, exePath)
 }
+
+// SetStaticConfig sets the config to use a static known_hosts file
+func (c *SSHConfig) SetStaticConfig(knownHostsPath string) {
+	c.Config = fmt.Sprintf(CfgStatic, knownHostsPath)
+}
+
+// IncludeLine returns the Include directive for the tailshale config file
+func IncludeLine(path string) string {
+	if strings.ContainsAny(path, " \t") {
+		path = `"` + path + `"`
+	}
+	return "Include " + path
+}
+
+// isInclude reports whether the line is an Include directive for path
+func isInclude(line, path string) bool {
+	keyword, arg, ok := strings.Cut(strings.TrimSpace(line), " ")
+	if !ok || !strings.EqualFold(keyword, "Include") {
+		return false
+	}
+	return strings.Trim(strings.TrimSpace(arg), `"`) == path
+}
+
+// removeInclude removes the Include lines for path from a section of the
+// config
+func removeInclude(section, path string) string {
+	if section == "" {
+		return section
+	}
+	lines := strings.Split(section, "\n")
+	return strings.Join(slices.DeleteFunc(lines, func(line string) bool {
+		return isInclude(line, path)
+	}), "\n")
+}
+
+// HasInclude reports whether the config includes path
+func (c *SSHConfig) HasInclude(path string) bool {
+	return slices.ContainsFunc(strings.Split(c.Beginning+"\n"+c.End, "\n"), func(line string) bool {
+		return isInclude(line, path)
+	})
+}
+
+// SetInclude puts the Include line for path at the top of the config,
+// removing it from anywhere else. An Include inside a Host or Match section
+// only applies to that section, so it has to come first.
+func (c *SSHConfig) SetInclude(path string) {
+	c.RemoveInclude(path)
+	if c.Beginning == "" {
+		c.Beginning = IncludeLine(path) + c.cr()
+		return
+	}
+	c.Beginning = IncludeLine(path) + c.cr() + "\n" + c.Beginning
+}
+
+// RemoveInclude removes the Include line for path
+func (c *SSHConfig) RemoveInclude(path string) {
+	c.Beginning = removeInclude(c.Beginning, path)
+	c.End = removeInclude(c.End, path)
+}
+
+// Position is where the tailshale block is placed in the SSH config
+type Position string
+
+const (
+	// PositionKeep leaves an existing block where it is and adds a new one
+	// at the bottom
+	PositionKeep Position = ""
+	// PositionTop places the block before the first Host or Match section,
+	// after any global options. Options after the block's Match line would
+	// only apply to tailnet hosts.
+	PositionTop    Position = "top"
+	PositionBottom Position = "bottom"
+	// PositionBefore places the block before a Host or Match section
+	PositionBefore Position = "before"
+	// PositionAfter places the block after a Host or Match section
+	PositionAfter Position = "after"
+)
+
+// Placement says where the tailshale block goes. Section is the Host or
+// Match line, such as "Host *", for PositionBefore and PositionAfter.
+type Placement struct {
+	Position Position
+	Section  string
+}
+
+// ParsePlacement parses "top", "bottom", "before:<section>" or
+// "after:<section>". An empty string keeps the block where it is.
+func ParsePlacement(s string) (Placement, error) {
+	position, section, _ := strings.Cut(s, ":")
+	p := Placement{Position: Position(strings.ToLower(strings.TrimSpace(position))), Section: strings.TrimSpace(section)}
+	switch p.Position {
+	case PositionKeep, PositionTop, PositionBottom:
+		if p.Section != "" {
+			return p, fmt.Errorf("invalid placement %q, %s does not take a section", s, p.Position)
+		}
+	case PositionBefore, PositionAfter:
+		if keyword, _ := parseConfigLine(p.Section); keyword != "host" && keyword != "match" {
+			return p, fmt.Errorf("invalid placement %q, %s needs a Host or Match section such as \"%s:Host *\"", s, p.Position, p.Position)
+		}
+	default:
+		return p, fmt.Errorf("invalid placement %q, must be top, bottom, before:<section> or after:<section>", s)
+	}
+	return p, nil
+}
+
+// parseConfigLine returns the lowercased keyword and the arguments of an SSH
+// config line, or an empty keyword for blank lines and comments
+func parseConfigLine(line string) (string, []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil
+	}
+	args := strings.Fields(strings.TrimLeft(line[end:], " \t="))
+	return strings.ToLower(line[:end]), args
+}
+
+// isSection reports whether the line starts a Host or Match section
+func isSection(line string) bool {
+	keyword, _ := parseConfigLine(line)
+	return keyword == "host" || keyword == "match"
+}
+
+// sameSection reports whether the line is the section header, ignoring case
+// and spacing
+func sameSection(line, section string) bool {
+	keyword, args := parseConfigLine(line)
+	want, wantArgs := parseConfigLine(section)
+	return keyword == want && strings.EqualFold(strings.Join(args, " "), strings.Join(wantArgs, " "))
+}
+
+// splitConfigLines splits a part of the config into lines, an empty part has
+// none
+func splitConfigLines(part string) []string {
+	if part == "" {
+		return nil
+	}
+	return strings.Split(part, "\n")
+}
+
+// withComments moves i back over the comment lines directly above it, so a
+// section's comments stay with it
+func withComments(lines []string, i int) int {
+	for i > 0 && strings.HasPrefix(strings.TrimSpace(lines[i-1]), "#") {
+		i--
+	}
+	return i
+}
+
+// Place moves the tailshale block. It returns an error if the section to
+// place it next to isn't in the config.
+func (c *SSHConfig) Place(p Placement) error {
+	if p.Position == PositionKeep {
+		return nil
+	}
+	lines := slices.Concat(splitConfigLines(c.Beginning), splitConfigLines(c.End))
+	split := 0
+	switch p.Position {
+	case PositionTop:
+		split = len(lines)
+		if first := slices.IndexFunc(lines, isSection); first >= 0 {
+			split = withComments(lines, first)
+		}
+	case PositionBottom:
+		split = len(lines)
+	case PositionBefore, PositionAfter:
+		i := slices.IndexFunc(lines, func(line string) bool { return sameSection(line, p.Section) })
+		if i < 0 {
+			return fmt.Errorf("section %q not found in SSH config", p.Section)
+		}
+		if p.Position == PositionBefore {
+			split = withComments(lines, i)
+			break
+		}
+		split = len(lines)
+		if next := slices.IndexFunc(lines[i+1:], isSection); next >= 0 {
+			split = withComments(lines, i+1+next)
+		}
+	default:
+		return fmt.Errorf("invalid position %q", p.Position)
+	}
+	c.Beginning = strings.Join(lines[:split], "\n")
+	c.End = strings.Join(lines[split:], "\n")
+	return nil
+}
+
+// overriddenOptions are the options that stop the tailshale config from
+// taking effect if they are set first
+var overriddenOptions = map[string]string{
+	"knownhostscommand":     "KnownHostsCommand",
+	"userknownhostsfile":    "UserKnownHostsFile",
+	"stricthostkeychecking": "StrictHostKeyChecking",
+}
+
+// tailnetHosts are example names a tailnet host may be reached by
+var tailnetHosts = []string{"host", "host.tailnet.ts.net", "100.64.0.1", "fd7a:115c:a1e0::1"}
+
+// matchesTailnetHost reports whether the Host patterns match a tailnet host
+func matchesTailnetHost(patterns []string) bool {
+	return slices.ContainsFunc(tailnetHosts, func(host string) bool {
+		matched := false
+		for _, pattern := range patterns {
+			negated := strings.HasPrefix(pattern, "!")
+			if ok, _ := path.Match(strings.ToLower(strings.TrimPrefix(pattern, "!")), host); ok {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+		return matched
+	})
+}
+
+// appliesToTailnet reports whether a section may apply to tailnet hosts.
+// Match criteria other than host and all can't be checked, so those sections
+// are assumed to apply.
+func appliesToTailnet(keyword string, args []string) bool {
+	if keyword == "host" {
+		return matchesTailnetHost(args)
+	}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "all", "canonical", "final":
+		case "host":
+			if i+1 < len(args) && !matchesTailnetHost(strings.Split(args[i+1], ",")) {
+				return false
+			}
+			i++
+		default:
+			return true
+		}
+	}
+	return true
+}
+
+// Conflicts returns warnings for options set before the tailshale block that
+// may apply to tailnet hosts. OpenSSH uses the first value it finds, so these
+// take precedence over the tailshale config.
+func (c *SSHConfig) Conflicts() []string {
+	if c.Config == "" {
+		return nil
+	}
+	warnings := []string{}
+	section := ""
+	applies := true
+	for i, line := range splitConfigLines(c.Beginning) {
+		keyword, args := parseConfigLine(line)
+		if keyword == "host" || keyword == "match" {
+			section = strings.TrimSpace(line)
+			applies = appliesToTailnet(keyword, args)
+			continue
+		}
+		option, ok := overriddenOptions[keyword]
+		if !ok || !applies {
+			continue
+		}
+		where := "the global options"
+		if section != "" {
+			where = fmt.Sprintf("the %s section", section)
+		}
+		warnings = append(warnings, fmt.Sprintf("line %d: %s is set in %s before the tailshale config and takes precedence for tailnet hosts", i+1, option, where))
+	}
+	return warnings
+}
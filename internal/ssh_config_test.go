@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/lithammer/dedent"
@@ -125,6 +126,75 @@ func TestNewSSHConfigFromFile(t *testing.T) {
 	}
 }
 
+func TestNewSSHConfigFromFile_Malformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		err   string
+	}{
+		{"Missing end marker", "Host a\n" + CfgStart + "\nconfig\nHost b\n  User b\n", "start marker on line 2 has no end marker"},
+		{"Missing end marker before the next block", CfgStart + "\nconfig\n" + CfgStart + "\nconfig\n" + CfgEnd + "\n", "start marker on line 1 has no end marker before line 3"},
+		{"Missing start marker", "Host a\n" + CfgEnd + "\n", "end marker on line 2 has no start marker"},
+		{"Duplicate block", CfgStart + "\na\n" + CfgEnd + "\nHost b\n" + CfgStart + "\na\n" + CfgEnd + "\n", "duplicate block on line 5, the first starts on line 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSSHConfigFromFile(strings.NewReader(tt.input))
+			require.ErrorIs(t, err, ErrMalformedConfig)
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+func TestNewSSHConfigFromFile_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+	}{
+		{"Content after the block", "Host a\n" + CfgStart + "\nconfig\n" + CfgEnd + "\nHost b\n  User b\n"},
+		{"No final newline", "Host a\n" + CfgStart + "\nconfig\n" + CfgEnd + "\nHost b"},
+		{"No final newline after the block", "Host a\n" + CfgStart + "\nconfig\n" + CfgEnd},
+		{"No block without final newline", "Host a\n  User a"},
+		{"Trailing blank lines", "Host a\n\n\n"},
+		{"CRLF", "Host a\r\n" + CfgStart + "\r\nconfig\r\n" + CfgEnd + "\r\nHost b\r\n"},
+		{"CRLF without final newline", "Host a\r\n" + CfgStart + "\r\nconfig\r\n" + CfgEnd},
+		{"CRLF without block or final newline", "Host a\r\n  User a"},
+		{"Mixed line endings", "Host a\r\n  User a\n" + CfgStart + "\nconfig\n" + CfgEnd + "\nHost b\r\n"},
+		{"Trailing whitespace", "Host a  \n" + CfgStart + " \t\nconfig\n" + CfgEnd + "  \nHost b\t\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := NewSSHConfigFromFile(strings.NewReader(tt.input))
+			require.NoError(t, err)
+			if strings.Contains(tt.input, CfgStart) {
+				assert.Equal(t, "config", cfg.Config, "Markers should be found")
+			}
+			expected := strings.NewReplacer(CfgStart+" \t", CfgStart, CfgEnd+"  ", CfgEnd).Replace(tt.input)
+			assert.Equal(t, expected, cfg.String())
+		})
+	}
+
+	t.Run("CRLF block", func(t *testing.T) {
+		cfg, err := NewSSHConfigFromFile(strings.NewReader("Host a\r\n  User a\r\n"))
+		require.NoError(t, err)
+		cfg.Config = "config line 1\nconfig line 2"
+		cfg.SetInclude("/tmp/tailshale.conf")
+		assert.Equal(t, "Include /tmp/tailshale.conf\r\nHost a\r\n  User a\r\n"+CfgStart+"\r\nconfig line 1\r\nconfig line 2\r\n"+CfgEnd+"\r\n", cfg.String())
+	})
+
+	t.Run("CRLF block without final newline", func(t *testing.T) {
+		cfg, err := NewSSHConfigFromFile(strings.NewReader("Host a\r\n  User a"))
+		require.NoError(t, err)
+		cfg.Config = "config"
+		assert.Equal(t, "Host a\r\n  User a\r\n"+CfgStart+"\r\nconfig\r\n"+CfgEnd, cfg.String(), "The block should be joined with CRLF")
+
+		cfg, err = NewSSHConfigFromFile(strings.NewReader(cfg.String()))
+		require.NoError(t, err)
+		cfg.Config = ""
+		assert.Equal(t, "Host a\r\n  User a", cfg.String(), "Removing the block should restore the file")
+	})
+}
+
 func TestSSHConfig_String(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -143,7 +213,7 @@ func TestSSHConfig_String(t *testing.T) {
 			config line 1
 			config line 2
 			###### End Tailshale ######
-			`),
+			`)[1:],
 		},
 		{
 			name: "Config with content above and below Tailshale config",
@@ -207,3 +277,163 @@ func TestSSHConfig_String(t *testing.T) {
 		})
 	}
 }
+
+func TestSSHConfig_Include(t *testing.T) {
+	path := "/home/user/.ssh/config.d/tailshale.conf"
+	cfg := SSHConfig{
+		Beginning: "Host example.com\n  User user",
+		End:       "  include " + path + "\nHost other.com",
+	}
+	assert.True(t, cfg.HasInclude(path))
+
+	cfg.SetInclude(path)
+	assert.Equal(t, "Include "+path+"\nHost example.com\n  User user", cfg.Beginning)
+	assert.Equal(t, "Host other.com", cfg.End, "Include should be moved to the top")
+
+	cfg.SetInclude(path)
+	assert.Equal(t, "Include "+path+"\nHost example.com\n  User user", cfg.Beginning, "SetInclude should be idempotent")
+
+	cfg.RemoveInclude(path)
+	assert.False(t, cfg.HasInclude(path))
+	assert.Equal(t, "Host example.com\n  User user", cfg.Beginning)
+
+	empty := SSHConfig{}
+	empty.SetInclude("/path with space/tailshale.conf")
+	assert.Equal(t, `Include "/path with space/tailshale.conf"`+"\n", empty.String())
+	assert.True(t, empty.HasInclude("/path with space/tailshale.conf"))
+}
+
+func TestParsePlacement(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Placement
+		err      bool
+	}{
+		{"", Placement{}, false},
+		{"top", Placement{Position: PositionTop}, false},
+		{"Bottom", Placement{Position: PositionBottom}, false},
+		{"before:Host *", Placement{Position: PositionBefore, Section: "Host *"}, false},
+		{"after: Match host *.ts.net", Placement{Position: PositionAfter, Section: "Match host *.ts.net"}, false},
+		{"before", Placement{}, true},
+		{"after:User me", Placement{}, true},
+		{"top:Host *", Placement{}, true},
+		{"middle", Placement{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			p, err := ParsePlacement(tt.input)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, p)
+		})
+	}
+}
+
+// optionSection returns the Host or Match line the option starting with
+// prefix applies under, or an empty string if it is a global option
+func optionSection(config, prefix string) string {
+	section := ""
+	for _, line := range strings.Split(config, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if isSection(trimmed) {
+			section = trimmed
+			continue
+		}
+		if strings.HasPrefix(trimmed, prefix) {
+			return section
+		}
+	}
+	return "not found"
+}
+
+func TestSSHConfig_Place(t *testing.T) {
+	input := dedent.Dedent(`
+	Host work
+	  User me
+
+	# Defaults for everything
+	Host *
+	  User default
+	###### Start Tailshale ######
+	config
+	###### End Tailshale ######
+	`)[1:]
+	tests := []struct {
+		name      string
+		placement Placement
+		expected  string
+	}{
+		{"Keep", Placement{}, input},
+		{"Top", Placement{Position: PositionTop}, CfgStart + "\nconfig\n" + CfgEnd + "\nHost work\n  User me\n\n# Defaults for everything\nHost *\n  User default\n"},
+		{"Bottom", Placement{Position: PositionBottom}, input},
+		{"Before", Placement{Position: PositionBefore, Section: "host  *"}, "Host work\n  User me\n\n" + CfgStart + "\nconfig\n" + CfgEnd + "\n# Defaults for everything\nHost *\n  User default\n"},
+		{"After", Placement{Position: PositionAfter, Section: "Host work"}, "Host work\n  User me\n\n" + CfgStart + "\nconfig\n" + CfgEnd + "\n# Defaults for everything\nHost *\n  User default\n"},
+		{"After the last section", Placement{Position: PositionAfter, Section: "Host *"}, input},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := NewSSHConfigFromFile(strings.NewReader(input))
+			require.NoError(t, err)
+			require.NoError(t, cfg.Place(tt.placement))
+			assert.Equal(t, tt.expected, cfg.String())
+		})
+	}
+
+	cfg, err := NewSSHConfigFromFile(strings.NewReader(input))
+	require.NoError(t, err)
+	assert.ErrorContains(t, cfg.Place(Placement{Position: PositionBefore, Section: "Host missing"}), "not found")
+
+	t.Run("Top keeps global options global", func(t *testing.T) {
+		input := "User alice\nIdentityFile ~/.ssh/id_alice\n\n# Work\nHost foo\n  User bob\n"
+		cfg, err := NewSSHConfigFromFile(strings.NewReader(input))
+		require.NoError(t, err)
+		cfg.SetConfig("tailshale")
+		require.NoError(t, cfg.Place(Placement{Position: PositionTop}))
+		out := cfg.String()
+		assert.Equal(t, "", optionSection(out, "User alice"), "Global options should stay global")
+		assert.Equal(t, "", optionSection(out, "IdentityFile ~/.ssh/id_alice"))
+		assert.Equal(t, "Host foo", optionSection(out, "User bob"))
+		assert.True(t, strings.HasPrefix(optionSection(out, "KnownHostsCommand"), "Match exec"))
+		assert.Less(t, strings.Index(out, CfgStart), strings.Index(out, "# Work"), "The block should be above the first section and its comments")
+	})
+
+	t.Run("Clean after top", func(t *testing.T) {
+		cfg, err := NewSSHConfigFromFile(strings.NewReader(input))
+		require.NoError(t, err)
+		require.NoError(t, cfg.Place(Placement{Position: PositionTop}))
+		cfg, err = NewSSHConfigFromFile(strings.NewReader(cfg.String()))
+		require.NoError(t, err)
+		cfg.Config = ""
+		assert.Equal(t, "Host work\n  User me\n\n# Defaults for everything\nHost *\n  User default\n", cfg.String(), "No blank line should be left at the top")
+	})
+}
+
+func TestSSHConfig_Conflicts(t *testing.T) {
+	cfg := SSHConfig{
+		Beginning: dedent.Dedent(`
+		StrictHostKeyChecking no
+		Host *.example.com
+		  UserKnownHostsFile /dev/null
+		Host *.corp !bastion.corp
+		  KnownHostsCommand /bin/true
+		Host *
+		  UserKnownHostsFile=~/.ssh/other
+		Match user root exec "true"
+		  StrictHostKeyChecking yes
+		Match host *.internal
+		  KnownHostsCommand /bin/false`)[1:],
+		Config: "config",
+		End:    "Host *\n  StrictHostKeyChecking no",
+	}
+	assert.Equal(t, []string{
+		"line 1: StrictHostKeyChecking is set in the global options before the tailshale config and takes precedence for tailnet hosts",
+		"line 7: UserKnownHostsFile is set in the Host * section before the tailshale config and takes precedence for tailnet hosts",
+		`line 9: StrictHostKeyChecking is set in the Match user root exec "true" section before the tailshale config and takes precedence for tailnet hosts`,
+	}, cfg.Conflicts())
+
+	cfg.Config = ""
+	assert.Empty(t, cfg.Conflicts(), "There are no conflicts without a tailshale block")
+}
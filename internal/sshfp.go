@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHFP algorithm numbers from RFC 4255, RFC 6594 and RFC 7479
+const (
+	SSHFPAlgorithmRSA     uint8 = 1
+	SSHFPAlgorithmECDSA   uint8 = 3
+	SSHFPAlgorithmED25519 uint8 = 4
+)
+
+// SSHFP fingerprint types from RFC 4255 and RFC 6594
+const (
+	SSHFPTypeSHA1   uint8 = 1
+	SSHFPTypeSHA256 uint8 = 2
+)
+
+// SSHFPAlgorithm returns the SSHFP algorithm number for the key, and false if
+// the key type has no assigned number.
+func SSHFPAlgorithm(key ssh.PublicKey) (uint8, bool) {
+	switch key.Type() {
+	case ssh.KeyAlgoRSA:
+		return SSHFPAlgorithmRSA, true
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return SSHFPAlgorithmECDSA, true
+	case ssh.KeyAlgoED25519:
+		return SSHFPAlgorithmED25519, true
+	default:
+		return 0, false
+	}
+}
+
+// SSHFPRecords returns the SHA-1 and SHA-256 SSHFP records for the key, owned
+// by name. Fingerprints are upper case hex, as printed by the zone file
+// parser. It returns nil if the key type has no SSHFP algorithm number.
+func SSHFPRecords(name string, key ssh.PublicKey, ttl uint32) []*dns.SSHFP {
+	algorithm, ok := SSHFPAlgorithm(key)
+	if !ok {
+		return nil
+	}
+	hdr := dns.RR_Header{
+		Name:   dns.Fqdn(name),
+		Rrtype: dns.TypeSSHFP,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+	sha1Sum := sha1.Sum(key.Marshal())
+	sha256Sum := sha256.Sum256(key.Marshal())
+	return []*dns.SSHFP{
+		{Hdr: hdr, Algorithm: algorithm, Type: SSHFPTypeSHA1, FingerPrint: strings.ToUpper(hex.EncodeToString(sha1Sum[:]))},
+		{Hdr: hdr, Algorithm: algorithm, Type: SSHFPTypeSHA256, FingerPrint: strings.ToUpper(hex.EncodeToString(sha256Sum[:]))},
+	}
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHFPRecords(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+
+	// Expected fingerprints from ssh-keygen -r
+	records := SSHFPRecords("test.example.ts.net", TEST_HOST_KEY_OBJECT, 300)
+	require.Len(t, records, 2)
+	assert.Equal(t, "test.example.ts.net.", records[0].Hdr.Name)
+	assert.Equal(t, uint16(dns.TypeSSHFP), records[0].Hdr.Rrtype)
+	assert.Equal(t, uint32(300), records[0].Hdr.Ttl)
+	assert.Equal(t, SSHFPAlgorithmED25519, records[0].Algorithm)
+	assert.Equal(t, SSHFPTypeSHA1, records[0].Type)
+	assert.Equal(t, strings.ToUpper("6763a7d444aad2ca871b7da8e8a7af89a59f4217"), records[0].FingerPrint)
+	assert.Equal(t, SSHFPTypeSHA256, records[1].Type)
+	assert.Equal(t, strings.ToUpper("6f1d90c26f656f01de952c7b906d3f27055fbabb8e20c88af3b7519f417835e4"), records[1].FingerPrint)
+
+	records = SSHFPRecords("test.example.ts.net.", rsaKey, 300)
+	require.Len(t, records, 2)
+	assert.Equal(t, SSHFPAlgorithmRSA, records[0].Algorithm)
+	assert.Equal(t, strings.ToUpper("6fe34212f1321a239650412c16a1f228f0d5bf4f"), records[0].FingerPrint)
+	assert.Equal(t, strings.ToUpper("eee87ea979a349f538b804bffb9f2f14c1c5288482645e93b70e39c4816faaaf"), records[1].FingerPrint)
+
+	// The records must survive a round trip through the zone file parser
+	rr, err := dns.NewRR(records[1].String())
+	require.NoError(t, err)
+	assert.True(t, dns.IsDuplicate(records[1], rr))
+}
+
+func TestSSHFPAlgorithm(t *testing.T) {
+	a, ok := SSHFPAlgorithm(TEST_HOST_KEY_OBJECT)
+	assert.True(t, ok)
+	assert.Equal(t, SSHFPAlgorithmED25519, a)
+}
@@ -15,9 +15,13 @@ import (
 
 var (
 	TEST_HOST_KEY                    = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILiup8poNplQGlzXuLDbn2Tz+/L3WxAwimSq7e+eTKjp testkey"
+	TEST_RSA_HOST_KEY                = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDq3D1tuwIIXvx4bMyc4G7o7URz1rcHZ1ShI77eCTcKqFyPP6YUaO/efl4OXJ3gKF6S0PB9+T3gPlbd7WnMkkVu4o1CsR8jbLoNBnppkLTXzXldUfIJoMcK3F+TyKgKNqOd7u+u4cClvBoMAGQHLyHhliWziVhLD5ljzq5DwiDUmw== testkey"
+	TEST_HOST_KEY_2                  = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHm0Asb2bE6MM5EEF78ZZfXHhuLF3iKDgGUC5GAgTzDW testkey2"
 	TEST_TAILNET                     = "example.ts.net"
+	TEST_NODE_ID                     = "nTEST1CNTRL"
 	TEST_HOST_KEY_OBJECT, _, _, _, _ = ssh.ParseAuthorizedKey([]byte(TEST_HOST_KEY))
 	TEST_IP                          = netip.MustParseAddr("100.100.100.100")
+	TEST_IP6                         = netip.MustParseAddr("fd7a:115c:a1e0::1")
 )
 
 func GetTestDNSMessage() []byte {
@@ -29,14 +33,31 @@ func GetTestDNSMessage() []byte {
 	return msg
 }
 
+func GetTestDNSMessageAAAA() []byte {
+	d := new(dns.Msg)
+	d.SetQuestion("test.example.ts.net.", dns.TypeAAAA)
+	r, _ := dns.NewRR("test.example.ts.net. IN AAAA fd7a:115c:a1e0::1")
+	d.Answer = []dns.RR{r}
+	msg, _ := d.Pack()
+	return msg
+}
+
 func GetTestNode(sshKey []string) *tailcfg.Node {
 	h := tailcfg.Hostinfo{
+		OS:           "linux",
 		SSH_HostKeys: sshKey,
 	}
 	hv := h.View()
 	node := &tailcfg.Node{
-		Name:     "test." + TEST_TAILNET,
-		Hostinfo: hv,
+		Name:              "test." + TEST_TAILNET,
+		StableID:          tailcfg.StableNodeID(TEST_NODE_ID),
+		Hostinfo:          hv,
+		Tags:              []string{"tag:server"},
+		MachineAuthorized: true,
+		Addresses: []netip.Prefix{
+			netip.PrefixFrom(TEST_IP, 32),
+			netip.PrefixFrom(TEST_IP6, 128),
+		},
 	}
 	return node
 }
@@ -59,3 +80,8 @@ func (m *MockClient) WhoIs(ctx context.Context, ip string) (*apitype.WhoIsRespon
 	args := m.Called(ctx, ip)
 	return args.Get(0).(*apitype.WhoIsResponse), args.Error(1)
 }
+
+func (m *MockClient) NetworkLockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(*ipnstate.NetworkLockStatus), args.Error(1)
+}
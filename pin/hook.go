@@ -0,0 +1,152 @@
+package pin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Hook is run when a node's keys change.
+type Hook interface {
+	Run(ctx context.Context, change Change) error
+}
+
+// CommandHook runs a shell command with the change as JSON on stdin. The host
+// and node ID are also passed in the TAILSHALE_HOST and TAILSHALE_NODE_ID
+// environment variables.
+type CommandHook struct {
+	Command string
+}
+
+func (h *CommandHook) Run(ctx context.Context, change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"TAILSHALE_HOST="+change.Host,
+		"TAILSHALE_NODE_ID="+change.NodeID,
+		"TAILSHALE_PIN_MODE="+string(change.Mode),
+	)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Error running %q: %w", h.Command, err)
+	}
+	return nil
+}
+
+// LogHook appends each change as a JSON line to a file, keeping an audit
+// trail of key rotations.
+type LogHook struct {
+	Fs   afero.Fs
+	Path string
+}
+
+func (h *LogHook) Run(ctx context.Context, change Change) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if err := h.Fs.MkdirAll(filepath.Dir(h.Path), 0700); err != nil {
+		return err
+	}
+	f, err := h.Fs.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// webhookTimeout bounds how long a lookup waits for the webhook
+const webhookTimeout = 5 * time.Second
+
+// WebhookHook posts the change as JSON to a local URL, either an http or
+// https URL on a loopback address or a unix socket such as
+// unix:///run/user/1000/alerts.sock.
+type WebhookHook struct {
+	URL    string
+	Client *http.Client
+}
+
+// CheckWebhookURL returns an error if the URL isn't local. Changes shouldn't
+// leave the machine, and a lookup shouldn't wait on a remote server.
+func CheckWebhookURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	switch u.Scheme {
+	case "unix":
+		if u.Path == "" {
+			return fmt.Errorf("webhook URL %s has no socket path", rawURL)
+		}
+		return nil
+	case "http", "https":
+		host := u.Hostname()
+		if host == "localhost" {
+			return nil
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return nil
+		}
+		return fmt.Errorf("webhook URL %s is not on a loopback address", rawURL)
+	}
+	return fmt.Errorf("webhook URL %s must be http, https or unix", rawURL)
+}
+
+func (h *WebhookHook) Run(ctx context.Context, change Change) error {
+	if err := CheckWebhookURL(h.URL); err != nil {
+		return err
+	}
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	target := h.URL
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: webhookTimeout}
+	}
+	if u, _ := url.Parse(h.URL); u.Scheme == "unix" {
+		// The host is ignored, every request is sent over the socket
+		target = "http://localhost/"
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", u.Path)
+			},
+		}
+		client = &http.Client{Timeout: client.Timeout, Transport: transport}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned %s", h.URL, resp.Status)
+	}
+	return nil
+}
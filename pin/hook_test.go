@@ -0,0 +1,107 @@
+package pin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testChange = Change{
+	NodeID:  in.TEST_NODE_ID,
+	Host:    "test.example.ts.net.",
+	OldKeys: []string{in.TEST_HOST_KEY},
+	NewKeys: []string{in.TEST_RSA_HOST_KEY},
+	Mode:    Warn,
+	Time:    time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+}
+
+func TestLogHook(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	h := &LogHook{Fs: fs, Path: "/log/tailshale/changes.log"}
+	require.NoError(t, h.Run(context.TODO(), testChange))
+	require.NoError(t, h.Run(context.TODO(), testChange))
+
+	data, err := afero.ReadFile(fs, h.Path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+	var decoded Change
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &decoded))
+	assert.Equal(t, testChange, decoded)
+}
+
+func TestWebhookHook(t *testing.T) {
+	var received Change
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer srv.Close()
+
+	require.NoError(t, (&WebhookHook{URL: srv.URL}).Run(context.TODO(), testChange))
+	assert.Equal(t, testChange, received)
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	assert.Error(t, (&WebhookHook{URL: failing.URL}).Run(context.TODO(), testChange))
+
+	t.Run("Unix socket", func(t *testing.T) {
+		socket := filepath.Join(t.TempDir(), "hook.sock")
+		l, err := net.Listen("unix", socket)
+		require.NoError(t, err)
+		var received Change
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		}))
+		srv.Listener = l
+		srv.Start()
+		defer srv.Close()
+
+		require.NoError(t, (&WebhookHook{URL: "unix://" + socket}).Run(context.TODO(), testChange))
+		assert.Equal(t, testChange, received)
+	})
+
+	t.Run("Remote URL", func(t *testing.T) {
+		err := (&WebhookHook{URL: "https://hooks.example.com/tailshale"}).Run(context.TODO(), testChange)
+		assert.ErrorContains(t, err, "loopback")
+	})
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+	for _, u := range []string{"http://localhost:8080/hook", "http://127.0.0.1/hook", "https://[::1]:8443/", "unix:///run/alerts.sock"} {
+		assert.NoError(t, CheckWebhookURL(u), u)
+	}
+	for _, u := range []string{"https://hooks.example.com/", "http://100.64.0.1/", "ftp://localhost/", "unix://", "http://localhost.example.com/"} {
+		assert.Error(t, CheckWebhookURL(u), u)
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "out")
+	h := &CommandHook{Command: `echo "$TAILSHALE_NODE_ID $TAILSHALE_HOST" > ` + out + ` && cat >> ` + out}
+	require.NoError(t, h.Run(context.TODO(), testChange))
+
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	first, rest, _ := strings.Cut(string(data), "\n")
+	assert.Equal(t, in.TEST_NODE_ID+" test.example.ts.net.", first)
+	var decoded Change
+	require.NoError(t, json.Unmarshal([]byte(rest), &decoded))
+	assert.Equal(t, testChange, decoded)
+
+	assert.Error(t, (&CommandHook{Command: "exit 1"}).Run(context.TODO(), testChange))
+}
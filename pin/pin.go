@@ -0,0 +1,330 @@
+// Package pin records the SSH host keys first seen for each Tailscale node
+// and detects when they change.
+package pin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+// Mode is what to do when a node's keys no longer match its pin.
+type Mode string
+
+const (
+	// Fail rejects the node until it is repinned
+	Fail Mode = "fail"
+	// Warn trusts the new keys but keeps the original pin
+	Warn Mode = "warn"
+	// Repin trusts the new keys and pins them
+	Repin Mode = "repin"
+)
+
+// Pin is the set of keys recorded for a node.
+type Pin struct {
+	Name      string    `json:"name"`
+	Keys      []string  `json:"keys"`
+	FirstSeen time.Time `json:"first_seen"`
+	Updated   time.Time `json:"updated"`
+	// Seen are the changed keys last reported, so a change that isn't
+	// repinned is only reported once
+	Seen []string `json:"seen,omitempty"`
+}
+
+// Change describes a node whose keys differ from its pin.
+type Change struct {
+	NodeID  string    `json:"node_id"`
+	Host    string    `json:"host"`
+	OldKeys []string  `json:"old_keys"`
+	NewKeys []string  `json:"new_keys"`
+	Mode    Mode      `json:"mode"`
+	Time    time.Time `json:"time"`
+	// Seen is set if the change was already reported
+	Seen bool `json:"-"`
+}
+
+// KeyChangedError is returned when a node's keys differ from its pin and the
+// mode is Fail.
+type KeyChangedError struct {
+	Host   string
+	NodeID string
+}
+
+func (e *KeyChangedError) Error() string {
+	return fmt.Sprintf("SSH host keys for %s (node %s) changed since they were pinned", e.Host, e.NodeID)
+}
+
+// Store keeps the pinned keys on disk, keyed by stable node ID. The file is
+// locked while it is read and written, so concurrent lookups don't lose each
+// other's pins.
+type Store struct {
+	fs   afero.Fs
+	path string
+	now  func() time.Time
+	// pins are loaded once and saved at the end of a Batch
+	pins  map[string]Pin
+	dirty bool
+}
+
+// DefaultPath returns the default location of the pin store in the user
+// config directory.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tailshale", "pins.json"), nil
+}
+
+func New(fs afero.Fs, path string) *Store {
+	return &Store{
+		fs:   fs,
+		path: path,
+		now:  time.Now,
+	}
+}
+
+// keyStrings returns the host's keys as sorted authorized_keys lines, so pins
+// don't depend on the order keys are advertised in.
+func keyStrings(host *ts.TailscaleHost) []string {
+	keys := make([]string, 0, len(host.Keys))
+	for _, key := range host.Keys {
+		keys = append(keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (s *Store) load() (map[string]Pin, error) {
+	pins := make(map[string]Pin)
+	data, err := afero.ReadFile(s.fs, s.path)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Unlike the cache a corrupt pin store is an error, treating it as empty
+	// would silently trust every key again.
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("Error reading pin store %s: %w", s.path, err)
+	}
+	return pins, nil
+}
+
+func (s *Store) save(pins map[string]Pin) error {
+	data, err := json.MarshalIndent(pins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return internal.WriteFileAtomic(s.fs, s.path, data, 0600)
+}
+
+// update runs fn on the pins, saving them if fn reports a change. Outside a
+// batch the store is locked, loaded and saved for each call.
+func (s *Store) update(fn func(pins map[string]Pin) (bool, error)) error {
+	if s.pins != nil {
+		changed, err := fn(s.pins)
+		s.dirty = s.dirty || changed
+		return err
+	}
+	unlock, err := internal.LockConfigFile(s.fs, s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+	changed, err := fn(pins)
+	if err != nil || !changed {
+		return err
+	}
+	return s.save(pins)
+}
+
+// Batch holds the lock on the store while fn runs, loading it once before
+// and saving it once after, so checking many hosts doesn't rewrite the file
+// for each one.
+func (s *Store) Batch(fn func() error) error {
+	if s.pins != nil {
+		return fn()
+	}
+	unlock, err := internal.LockConfigFile(s.fs, s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock() //nolint:errcheck
+	pins, err := s.load()
+	if err != nil {
+		return err
+	}
+	s.pins, s.dirty = pins, false
+	defer func() { s.pins = nil }()
+	if err := fn(); err != nil {
+		return err
+	}
+	if !s.dirty {
+		return nil
+	}
+	return s.save(s.pins)
+}
+
+// Get returns the pin for the node and whether it exists.
+func (s *Store) Get(nodeID string) (Pin, bool, error) {
+	var p Pin
+	var ok bool
+	err := s.update(func(pins map[string]Pin) (bool, error) {
+		p, ok = pins[nodeID]
+		return false, nil
+	})
+	return p, ok, err
+}
+
+// Check compares the host's keys with its pin, pinning them if the node has
+// not been seen before. It returns the change if the keys differ.
+func (s *Store) Check(host *ts.TailscaleHost) (*Change, error) {
+	keys := keyStrings(host)
+	var change *Change
+	err := s.update(func(pins map[string]Pin) (bool, error) {
+		p, ok := pins[host.NodeID]
+		if !ok {
+			now := s.now()
+			pins[host.NodeID] = Pin{Name: host.Name, Keys: keys, FirstSeen: now, Updated: now}
+			return true, nil
+		}
+		if slices.Equal(p.Keys, keys) {
+			return false, nil
+		}
+		change = &Change{
+			NodeID:  host.NodeID,
+			Host:    host.Name,
+			OldKeys: p.Keys,
+			NewKeys: keys,
+			Time:    s.now(),
+			Seen:    slices.Equal(p.Seen, keys),
+		}
+		return false, nil
+	})
+	return change, err
+}
+
+// Acknowledge records that the host's changed keys were reported, so the
+// same change isn't reported again.
+func (s *Store) Acknowledge(host *ts.TailscaleHost) error {
+	keys := keyStrings(host)
+	return s.update(func(pins map[string]Pin) (bool, error) {
+		p, ok := pins[host.NodeID]
+		if !ok || slices.Equal(p.Seen, keys) {
+			return false, nil
+		}
+		p.Seen = keys
+		pins[host.NodeID] = p
+		return true, nil
+	})
+}
+
+// Pin records the host's current keys, replacing any existing pin.
+func (s *Store) Pin(host *ts.TailscaleHost) error {
+	return s.update(func(pins map[string]Pin) (bool, error) {
+		now := s.now()
+		p, ok := pins[host.NodeID]
+		if !ok {
+			p.FirstSeen = now
+		}
+		p.Name = host.Name
+		p.Keys = keyStrings(host)
+		p.Seen = nil
+		p.Updated = now
+		pins[host.NodeID] = p
+		return true, nil
+	})
+}
+
+// Guard checks hosts against the pin store, running the hooks and applying
+// the mode when their keys change.
+type Guard struct {
+	Store *Store
+	Mode  Mode
+	Hooks []Hook
+	// Warn receives warnings about changed keys, defaults to os.Stderr
+	Warn io.Writer
+}
+
+func NewGuard(store *Store, mode Mode, hooks ...Hook) *Guard {
+	return &Guard{
+		Store: store,
+		Mode:  mode,
+		Hooks: hooks,
+		Warn:  os.Stderr,
+	}
+}
+
+// Check returns an error if the host's keys changed since they were pinned
+// and the mode is Fail. A nil guard accepts every host. Nodes without a
+// stable ID can't be pinned and are accepted.
+func (g *Guard) Check(ctx context.Context, host *ts.TailscaleHost) error {
+	if g == nil || host.NodeID == "" {
+		return nil
+	}
+	change, err := g.Store.Check(host)
+	if err != nil {
+		return err
+	}
+	if change == nil {
+		return nil
+	}
+
+	mode := g.Mode
+	if mode == "" {
+		mode = Fail
+	}
+	change.Mode = mode
+	// A single ssh connection looks the host up several times, so the hooks
+	// only run the first time a change is seen
+	if !change.Seen {
+		for _, hook := range g.Hooks {
+			if err := hook.Run(ctx, *change); err != nil {
+				fmt.Fprintf(g.Warn, "Warning: key change hook failed: %v\n", err)
+			}
+		}
+		if mode != Repin {
+			if err := g.Store.Acknowledge(host); err != nil {
+				return err
+			}
+		}
+	}
+
+	switch mode {
+	case Fail:
+		return &KeyChangedError{Host: host.Name, NodeID: host.NodeID}
+	case Warn:
+		fmt.Fprintf(g.Warn, "Warning: SSH host keys for %s changed since they were pinned\n", host.Name)
+		return nil
+	case Repin:
+		fmt.Fprintf(g.Warn, "Warning: SSH host keys for %s changed, pinning the new keys\n", host.Name)
+		return g.Store.Pin(host)
+	}
+	return fmt.Errorf("invalid pin mode %q", mode)
+}
+
+// Batch runs fn with the pin store loaded and locked, saving it once at the
+// end. A nil guard just runs fn.
+func (g *Guard) Batch(fn func() error) error {
+	if g == nil {
+		return fn()
+	}
+	return g.Store.Batch(fn)
+}
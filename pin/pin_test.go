@@ -0,0 +1,165 @@
+package pin
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+const testPath = "/config/tailshale/pins.json"
+
+func testHosts(t *testing.T) (*ts.TailscaleHost, *ts.TailscaleHost) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+	host := &ts.TailscaleHost{
+		Name:   "test.example.ts.net.",
+		NodeID: in.TEST_NODE_ID,
+		Keys:   []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+	}
+	rotated := &ts.TailscaleHost{
+		Name:   "renamed.example.ts.net.",
+		NodeID: in.TEST_NODE_ID,
+		Keys:   []ssh.PublicKey{rsaKey},
+	}
+	return host, rotated
+}
+
+type recordingHook struct {
+	changes []Change
+}
+
+func (h *recordingHook) Run(ctx context.Context, change Change) error {
+	h.changes = append(h.changes, change)
+	return nil
+}
+
+func TestStore_Check(t *testing.T) {
+	host, rotated := testHosts(t)
+	s := New(afero.NewMemMapFs(), testPath)
+
+	change, err := s.Check(host)
+	require.NoError(t, err)
+	assert.Nil(t, change, "First use should pin the keys")
+	p, ok, err := s.Get(in.TEST_NODE_ID)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, host.Name, p.Name)
+	assert.Len(t, p.Keys, 1)
+
+	change, err = s.Check(host)
+	require.NoError(t, err)
+	assert.Nil(t, change)
+
+	change, err = s.Check(rotated)
+	require.NoError(t, err)
+	require.NotNil(t, change)
+	assert.Equal(t, in.TEST_NODE_ID, change.NodeID)
+	assert.Equal(t, p.Keys, change.OldKeys)
+	assert.NotEqual(t, change.OldKeys, change.NewKeys)
+
+	require.NoError(t, s.Pin(rotated))
+	repinned, _, err := s.Get(in.TEST_NODE_ID)
+	require.NoError(t, err)
+	assert.Equal(t, change.NewKeys, repinned.Keys)
+	assert.Equal(t, p.FirstSeen, repinned.FirstSeen)
+}
+
+func TestStore_Batch(t *testing.T) {
+	host, rotated := testHosts(t)
+	other := *host
+	other.NodeID = "nOTHER1CNTRL"
+	fs := afero.NewMemMapFs()
+	s := New(fs, testPath)
+
+	err := s.Batch(func() error {
+		for _, h := range []*ts.TailscaleHost{host, &other} {
+			if _, err := s.Check(h); err != nil {
+				return err
+			}
+		}
+		exists, _ := afero.Exists(fs, testPath)
+		assert.False(t, exists, "Pins should only be saved at the end of the batch")
+		return s.Pin(rotated)
+	})
+	require.NoError(t, err)
+
+	pins, err := New(fs, testPath).load()
+	require.NoError(t, err)
+	assert.Len(t, pins, 2)
+	assert.Equal(t, keyStrings(rotated), pins[in.TEST_NODE_ID].Keys)
+}
+
+func TestStore_Corrupt(t *testing.T) {
+	host, _ := testHosts(t)
+	fs := afero.NewMemMapFs()
+	require.NoError(t, afero.WriteFile(fs, testPath, []byte("not json"), 0600))
+	_, err := New(fs, testPath).Check(host)
+	assert.Error(t, err, "A corrupt pin store must not be treated as empty")
+}
+
+func TestGuard_Check(t *testing.T) {
+	host, rotated := testHosts(t)
+	key2, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_HOST_KEY_2))
+	require.NoError(t, err)
+	tests := []struct {
+		mode     Mode
+		wantErr  bool
+		repinned bool
+	}{
+		{mode: Fail, wantErr: true},
+		{mode: "", wantErr: true},
+		{mode: Warn},
+		{mode: Repin, repinned: true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			hook := &recordingHook{}
+			var warn bytes.Buffer
+			g := NewGuard(New(afero.NewMemMapFs(), testPath), tt.mode, hook)
+			g.Warn = &warn
+
+			require.NoError(t, g.Check(context.TODO(), host))
+			err := g.Check(context.TODO(), rotated)
+			if tt.wantErr {
+				var changed *KeyChangedError
+				assert.ErrorAs(t, err, &changed)
+			} else {
+				assert.NoError(t, err)
+				assert.Contains(t, warn.String(), "changed")
+			}
+			require.Len(t, hook.changes, 1)
+			assert.Equal(t, rotated.Name, hook.changes[0].Host)
+
+			err = g.Check(context.TODO(), rotated)
+			if tt.wantErr {
+				assert.Error(t, err, "The keys should be rejected until they are repinned")
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, hook.changes, 1, "Each change should only be reported once")
+
+			// Rotating again is a new change
+			again := *rotated
+			again.Keys = []ssh.PublicKey{key2}
+			g.Check(context.TODO(), &again) //nolint:errcheck
+			assert.Len(t, hook.changes, 2)
+		})
+	}
+
+	t.Run("nil guard", func(t *testing.T) {
+		var g *Guard
+		assert.NoError(t, g.Check(context.TODO(), rotated))
+	})
+
+	t.Run("no node ID", func(t *testing.T) {
+		g := NewGuard(New(afero.NewMemMapFs(), testPath), Fail)
+		assert.NoError(t, g.Check(context.TODO(), &ts.TailscaleHost{Name: "legacy"}))
+	})
+}
@@ -0,0 +1,271 @@
+// Package policy decides which Tailscale nodes are trusted to vouch for their
+// SSH host keys.
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"golang.org/x/crypto/ssh"
+)
+
+// Rule matches nodes by their Tailscale metadata. Every non-empty field must
+// match, a field matches if any of its values match. Owners may use glob
+// patterns such as "*@example.com".
+type Rule struct {
+	Tags   []string `mapstructure:"tags"`
+	Owners []string `mapstructure:"owners"`
+	OS     []string `mapstructure:"os"`
+}
+
+// Action is what to do with a node in a questionable state.
+type Action string
+
+const (
+	// Refuse rejects the node
+	Refuse Action = "refuse"
+	// Warn trusts the node but logs a warning
+	Warn Action = "warn"
+	// Allow trusts the node
+	Allow Action = "allow"
+)
+
+// Policy selects which nodes host keys are trusted from. Node states are
+// checked first, then deny rules, then if there are any allow rules a node
+// must match one of them. An empty policy trusts every node that is
+// authorized and has a valid key.
+type Policy struct {
+	Allow []Rule `mapstructure:"allow"`
+	Deny  []Rule `mapstructure:"deny"`
+	// RequireKeyExpiry rejects nodes that have key expiry disabled
+	RequireKeyExpiry bool `mapstructure:"require_key_expiry"`
+	// KeyExpired is the action for nodes with an expired key, defaults to Refuse
+	KeyExpired Action `mapstructure:"key_expired"`
+	// Unauthorized is the action for unauthorized machines, defaults to Refuse
+	Unauthorized Action `mapstructure:"unauthorized"`
+	// Stale is the action for nodes offline longer than StaleAfter, defaults
+	// to Warn
+	Stale Action `mapstructure:"stale"`
+	// StaleAfter is how long a node may be offline, zero disables the check
+	StaleAfter time.Duration `mapstructure:"stale_after"`
+	// CertAuthorities are trusted to sign host certificates
+	CertAuthorities []CertAuthority `mapstructure:"cert_authorities"`
+	// Revoked keys are never trusted, given as authorized_keys lines or
+	// SHA256 fingerprints
+	Revoked []string `mapstructure:"revoked"`
+}
+
+// CertAuthority is a certificate authority trusted to sign the host keys of
+// hosts matching the patterns. Without patterns it applies to the tailnet's
+// names.
+type CertAuthority struct {
+	Key   string   `mapstructure:"key"`
+	Hosts []string `mapstructure:"hosts"`
+}
+
+// PublicKey parses the certificate authority key.
+func (ca CertAuthority) PublicKey() (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(ca.Key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid cert authority key %q: %w", ca.Key, err)
+	}
+	return key, nil
+}
+
+// isFingerprint reports whether the revocation entry is a fingerprint rather
+// than a key.
+func isFingerprint(entry string) bool {
+	return strings.HasPrefix(entry, "SHA256:")
+}
+
+// Validate checks that the cert authority keys and revocation entries parse.
+func (p *Policy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, state := range []struct {
+		name   string
+		action Action
+	}{
+		{"key_expired", p.KeyExpired},
+		{"unauthorized", p.Unauthorized},
+		{"stale", p.Stale},
+	} {
+		if state.action != "" && !slices.Contains([]Action{Refuse, Warn, Allow}, state.action) {
+			return fmt.Errorf("invalid %s action %q, must be one of %s, %s or %s", state.name, state.action, Refuse, Warn, Allow)
+		}
+	}
+	for _, ca := range p.CertAuthorities {
+		if _, err := ca.PublicKey(); err != nil {
+			return err
+		}
+	}
+	for _, entry := range p.Revoked {
+		if isFingerprint(entry) {
+			continue
+		}
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry)); err != nil {
+			return fmt.Errorf("invalid revoked key %q: %w", entry, err)
+		}
+	}
+	return nil
+}
+
+// RevokedKeys returns the revoked keys that are given as authorized_keys
+// lines, skipping fingerprints and invalid entries.
+func (p *Policy) RevokedKeys() []ssh.PublicKey {
+	if p == nil {
+		return nil
+	}
+	var keys []ssh.PublicKey
+	for _, entry := range p.Revoked {
+		if isFingerprint(entry) {
+			continue
+		}
+		if key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(entry)); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// IsRevoked reports whether the key is on the revocation list.
+func (p *Policy) IsRevoked(key ssh.PublicKey) bool {
+	if p == nil {
+		return false
+	}
+	fingerprint := ssh.FingerprintSHA256(key)
+	if slices.Contains(p.Revoked, fingerprint) {
+		return true
+	}
+	return slices.ContainsFunc(p.RevokedKeys(), func(revoked ssh.PublicKey) bool {
+		return bytes.Equal(revoked.Marshal(), key.Marshal())
+	})
+}
+
+// RejectedError is returned when a node is not trusted by the policy.
+type RejectedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("host %s rejected by policy: %s", e.Host, e.Reason)
+}
+
+func normalizeTag(tag string) string {
+	if !strings.HasPrefix(tag, "tag:") {
+		return "tag:" + tag
+	}
+	return tag
+}
+
+// Match reports whether the rule matches the host.
+func (r Rule) Match(host *ts.TailscaleHost) bool {
+	if len(r.Tags) > 0 && !slices.ContainsFunc(r.Tags, func(tag string) bool {
+		return slices.Contains(host.Tags, normalizeTag(tag))
+	}) {
+		return false
+	}
+	if len(r.Owners) > 0 && !slices.ContainsFunc(r.Owners, func(owner string) bool {
+		ok, err := path.Match(strings.ToLower(owner), strings.ToLower(host.Owner))
+		return err == nil && ok
+	}) {
+		return false
+	}
+	if len(r.OS) > 0 && !slices.ContainsFunc(r.OS, func(os string) bool {
+		return strings.EqualFold(os, host.OS)
+	}) {
+		return false
+	}
+	return true
+}
+
+// String describes the rule for log messages.
+func (r Rule) String() string {
+	var parts []string
+	if len(r.Tags) > 0 {
+		parts = append(parts, "tags="+strings.Join(r.Tags, ","))
+	}
+	if len(r.Owners) > 0 {
+		parts = append(parts, "owners="+strings.Join(r.Owners, ","))
+	}
+	if len(r.OS) > 0 {
+		parts = append(parts, "os="+strings.Join(r.OS, ","))
+	}
+	if len(parts) == 0 {
+		return "any"
+	}
+	return strings.Join(parts, " ")
+}
+
+// Result is the outcome of evaluating a host against the policy.
+type Result struct {
+	Warnings []string
+}
+
+// checkState applies the action for a node state, returning an error if the
+// node is refused.
+func checkState(action, def Action, host *ts.TailscaleHost, reason string, result *Result) error {
+	if action == "" {
+		action = def
+	}
+	switch action {
+	case Allow:
+		return nil
+	case Warn:
+		result.Warnings = append(result.Warnings, fmt.Sprintf("host %s: %s", host.Name, reason))
+		return nil
+	case Refuse:
+		return &RejectedError{Host: host.Name, Reason: reason}
+	}
+	return fmt.Errorf("invalid policy action %q", action)
+}
+
+// Evaluate returns a RejectedError if the host is not trusted. Warnings for
+// hosts that are trusted despite their state are returned in the result.
+func (p *Policy) Evaluate(host *ts.TailscaleHost) (Result, error) {
+	result := Result{}
+	if p == nil {
+		p = &Policy{}
+	}
+	now := time.Now()
+	if !host.Authorized {
+		if err := checkState(p.Unauthorized, Refuse, host, "machine is not authorized", &result); err != nil {
+			return result, err
+		}
+	}
+	if host.KeyExpired(now) {
+		if err := checkState(p.KeyExpired, Refuse, host, "node key has expired", &result); err != nil {
+			return result, err
+		}
+	}
+	if host.Stale(now, p.StaleAfter) {
+		reason := fmt.Sprintf("node last seen %s ago", now.Sub(host.LastSeen).Round(time.Minute))
+		if err := checkState(p.Stale, Warn, host, reason, &result); err != nil {
+			return result, err
+		}
+	}
+	if p.RequireKeyExpiry && host.KeyExpiry.IsZero() {
+		return result, &RejectedError{Host: host.Name, Reason: "key expiry is disabled"}
+	}
+	for _, rule := range p.Deny {
+		if rule.Match(host) {
+			return result, &RejectedError{Host: host.Name, Reason: "matches deny rule " + rule.String()}
+		}
+	}
+	if len(p.Allow) == 0 {
+		return result, nil
+	}
+	for _, rule := range p.Allow {
+		if rule.Match(host) {
+			return result, nil
+		}
+	}
+	return result, &RejectedError{Host: host.Name, Reason: "no allow rule matches"}
+}
@@ -0,0 +1,146 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	in "github.com/evilhamsterman/tailshale/internal"
+	ts "github.com/evilhamsterman/tailshale/tailscale"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPolicy_Evaluate(t *testing.T) {
+	server := &ts.TailscaleHost{
+		Name:       "server.example.ts.net.",
+		Tags:       []string{"tag:server"},
+		Owner:      "tagged-devices",
+		OS:         "linux",
+		Authorized: true,
+	}
+	laptop := &ts.TailscaleHost{
+		Name:       "laptop.example.ts.net.",
+		Owner:      "alice@example.com",
+		OS:         "macOS",
+		KeyExpiry:  time.Now().Add(time.Hour),
+		Authorized: true,
+	}
+	unauthorized := &ts.TailscaleHost{
+		Name: "new.example.ts.net.",
+		OS:   "linux",
+	}
+	expired := &ts.TailscaleHost{
+		Name:       "expired.example.ts.net.",
+		KeyExpiry:  time.Now().Add(-time.Hour),
+		Authorized: true,
+	}
+	stale := &ts.TailscaleHost{
+		Name:       "stale.example.ts.net.",
+		LastSeen:   time.Now().Add(-90 * 24 * time.Hour),
+		Authorized: true,
+	}
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		host    *ts.TailscaleHost
+		allowed bool
+	}{
+		{"Nil policy", nil, laptop, true},
+		{"Empty policy", &Policy{}, laptop, true},
+		{"Allow tag", &Policy{Allow: []Rule{{Tags: []string{"server"}}}}, server, true},
+		{"Allow tag rejects untagged", &Policy{Allow: []Rule{{Tags: []string{"server"}}}}, laptop, false},
+		{"Allow owner glob", &Policy{Allow: []Rule{{Owners: []string{"*@example.com"}}}}, laptop, true},
+		{"Deny OS", &Policy{Deny: []Rule{{OS: []string{"macos"}}}}, laptop, false},
+		{"Deny wins over allow", &Policy{
+			Allow: []Rule{{Owners: []string{"alice@example.com"}}},
+			Deny:  []Rule{{OS: []string{"macOS"}}},
+		}, laptop, false},
+		{"Rule fields are combined", &Policy{Allow: []Rule{{Tags: []string{"server"}, OS: []string{"windows"}}}}, server, false},
+		{"Require key expiry", &Policy{RequireKeyExpiry: true}, server, false},
+		{"Require key expiry allows expiring", &Policy{RequireKeyExpiry: true}, laptop, true},
+		{"Unauthorized refused by default", &Policy{}, unauthorized, false},
+		{"Unauthorized allowed", &Policy{Unauthorized: Allow}, unauthorized, true},
+		{"Expired refused by default", nil, expired, false},
+		{"Expired warn", &Policy{KeyExpired: Warn}, expired, true},
+		{"Stale warns by default", &Policy{StaleAfter: 24 * time.Hour}, stale, true},
+		{"Stale refused", &Policy{StaleAfter: 24 * time.Hour, Stale: Refuse}, stale, false},
+		{"Stale check disabled", &Policy{Stale: Refuse}, stale, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.policy.Evaluate(tt.host)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				var rejected *RejectedError
+				assert.ErrorAs(t, err, &rejected)
+			}
+		})
+	}
+}
+
+func TestPolicy_Warnings(t *testing.T) {
+	stale := &ts.TailscaleHost{
+		Name:       "stale.example.ts.net.",
+		LastSeen:   time.Now().Add(-48 * time.Hour),
+		Authorized: true,
+		Expired:    true,
+	}
+	p := &Policy{StaleAfter: 24 * time.Hour, KeyExpired: Warn}
+	result, err := p.Evaluate(stale)
+	assert.NoError(t, err)
+	assert.Len(t, result.Warnings, 2)
+
+	_, err = (&Policy{KeyExpired: "bogus"}).Evaluate(stale)
+	assert.Error(t, err)
+}
+
+func TestPolicy_Revoked(t *testing.T) {
+	rsaKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(in.TEST_RSA_HOST_KEY))
+	require.NoError(t, err)
+
+	var nilPolicy *Policy
+	assert.False(t, nilPolicy.IsRevoked(in.TEST_HOST_KEY_OBJECT))
+	assert.NoError(t, nilPolicy.Validate())
+
+	byKey := &Policy{Revoked: []string{in.TEST_HOST_KEY}}
+	assert.NoError(t, byKey.Validate())
+	assert.True(t, byKey.IsRevoked(in.TEST_HOST_KEY_OBJECT))
+	assert.False(t, byKey.IsRevoked(rsaKey))
+	assert.Len(t, byKey.RevokedKeys(), 1)
+
+	byFingerprint := &Policy{Revoked: []string{ssh.FingerprintSHA256(rsaKey)}}
+	assert.NoError(t, byFingerprint.Validate())
+	assert.True(t, byFingerprint.IsRevoked(rsaKey))
+	assert.False(t, byFingerprint.IsRevoked(in.TEST_HOST_KEY_OBJECT))
+	assert.Empty(t, byFingerprint.RevokedKeys())
+
+	assert.Error(t, (&Policy{Revoked: []string{"not a key"}}).Validate())
+}
+
+func TestPolicy_ValidateActions(t *testing.T) {
+	assert.NoError(t, (&Policy{}).Validate(), "Empty actions use the defaults")
+	assert.NoError(t, (&Policy{KeyExpired: Allow, Unauthorized: Warn, Stale: Refuse}).Validate())
+
+	for _, p := range []*Policy{
+		{KeyExpired: "ignore"},
+		{Unauthorized: "Refuse"},
+		{Stale: "warning"},
+	} {
+		assert.Error(t, p.Validate())
+	}
+	assert.EqualError(t, (&Policy{Stale: "warning"}).Validate(), `invalid stale action "warning", must be one of refuse, warn or allow`)
+}
+
+func TestPolicy_CertAuthorities(t *testing.T) {
+	ca := CertAuthority{Key: in.TEST_HOST_KEY, Hosts: []string{"*.example.ts.net"}}
+	key, err := ca.PublicKey()
+	require.NoError(t, err)
+	assert.Equal(t, in.TEST_HOST_KEY_OBJECT.Marshal(), key.Marshal())
+
+	assert.NoError(t, (&Policy{CertAuthorities: []CertAuthority{ca}}).Validate())
+	assert.Error(t, (&Policy{CertAuthorities: []CertAuthority{{Key: "bogus"}}}).Validate())
+}
@@ -1,21 +1,31 @@
 package tailscale
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"net/netip"
+	"slices"
 	"strings"
 
 	"github.com/miekg/dns"
 	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/local"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
 )
 
 var _ Client = (*local.Client)(nil) // Ensure the tailscale local.Client implements the Client interface
+var _ HostGetter = (*TSClient)(nil) // Ensure TSClient implements the HostGetter interface
 
 type TSClient struct {
-	Client  Client
-	Tailnet string
+	Client      Client
+	Tailnet     string
+	MagicDNS    bool        // Whether MagicDNS is enabled for the tailnet
+	Resolver    ResolveMode // How hostnames are resolved, defaults to ResolveAuto
+	TailnetLock LockMode    // Whether peers must pass Tailnet Lock, defaults to LockOff
 }
 
 func NewTSClient(c Client) (*TSClient, error) {
@@ -25,37 +35,149 @@ func NewTSClient(c Client) (*TSClient, error) {
 	}
 	status, err := client.Client.Status(ctx)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("%w: %w", ErrUnavailable, err)
 	}
 	client.Tailnet = status.CurrentTailnet.MagicDNSSuffix
+	client.MagicDNS = status.CurrentTailnet.MagicDNSEnabled
 	return client, nil
 }
 
+// qualify appends the tailnet suffix to short names. Names that already
+// contain a domain are left as is, so nodes shared in from other tailnets can
+// be looked up by their own FQDN.
+func (c *TSClient) qualify(host string) string {
+	host = strings.TrimSuffix(host, ".")
+	if strings.Contains(host, ".") || c.Tailnet == "" {
+		return host
+	}
+	return host + "." + c.Tailnet
+}
+
+// IsShared reports whether the DNS name belongs to a node shared in from
+// another tailnet.
+func (c *TSClient) IsShared(dnsName string) bool {
+	if c.Tailnet == "" || dnsName == "" {
+		return false
+	}
+	dnsName = strings.ToLower(strings.TrimSuffix(dnsName, "."))
+	return !strings.HasSuffix(dnsName, "."+strings.ToLower(c.Tailnet))
+}
+
 // QueryTSDNS queries the Tailscale DNS for the given host.
-// It returns the IP address if found, or an error if not found.
-func (c *TSClient) QueryTSDNS(ctx context.Context, host string) (netip.Addr, error) {
-	// Check if the host ends with the Tailnet suffix
-	if !strings.HasSuffix(host, c.Tailnet) {
-		host = host + "." + c.Tailnet
+// It returns the IPv4 and IPv6 addresses if found, or an error if not found.
+func (c *TSClient) QueryTSDNS(ctx context.Context, host string) ([]netip.Addr, error) {
+	host = c.qualify(host)
+	var ips []netip.Addr
+	var queryErr error
+	for _, qtype := range []string{"A", "AAAA"} {
+		msg, _, err := c.Client.QueryDNS(ctx, host, qtype)
+		if err != nil {
+			queryErr = err
+			continue
+		}
+		// Parse the DNS response
+		dnsMsg := new(dns.Msg)
+		if err := dnsMsg.Unpack(msg); err != nil {
+			queryErr = err
+			continue
+		}
+		// Check for A and AAAA records in the response
+		for _, ans := range dnsMsg.Answer {
+			switch rr := ans.(type) {
+			case *dns.A:
+				if ip, ok := netip.AddrFromSlice(rr.A); ok {
+					ips = append(ips, ip.Unmap())
+				}
+			case *dns.AAAA:
+				if ip, ok := netip.AddrFromSlice(rr.AAAA); ok {
+					ips = append(ips, ip)
+				}
+			}
+		}
 	}
-	msg, _, err := c.Client.QueryDNS(ctx, host, "A")
+	if len(ips) == 0 {
+		if queryErr != nil {
+			return nil, queryErr
+		}
+		// If no records found, return an error
+		return nil, fmt.Errorf("no A or AAAA record found for %s", host)
+	}
+	return ips, nil
+}
+
+// QueryNetmap resolves the host from the peers in the Tailscale status. The
+// host is matched against the peer DNS names, short names, hostnames and IP
+// addresses, so it works without MagicDNS.
+func (c *TSClient) QueryNetmap(ctx context.Context, host string) ([]netip.Addr, error) {
+	status, err := c.Client.Status(ctx)
 	if err != nil {
-		return netip.Addr{}, err
+		return nil, fmt.Errorf("failed to get Tailscale status: %w", err)
+	}
+	peers := make([]*ipnstate.PeerStatus, 0, len(status.Peer)+1)
+	if status.Self != nil {
+		peers = append(peers, status.Self)
 	}
-	// Parse the DNS response
-	dnsMsg := new(dns.Msg)
-	if err := dnsMsg.Unpack(msg); err != nil {
-		return netip.Addr{}, err
+	for _, peer := range status.Peer {
+		peers = append(peers, peer)
 	}
-	// Check for A records in the response
-	for _, ans := range dnsMsg.Answer {
-		if a, ok := ans.(*dns.A); ok {
-			ip, _ := netip.AddrFromSlice(a.A)
-			return ip, nil
+
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	addr, addrErr := netip.ParseAddr(host)
+	// Matches are ranked so a full DNS name or IP wins over a short name, and
+	// a short name in this tailnet wins over one shared in from another
+	var exact, short, shared []*ipnstate.PeerStatus
+	for _, peer := range peers {
+		if peer == nil {
+			continue
+		}
+		dnsName := strings.TrimSuffix(strings.ToLower(peer.DNSName), ".")
+		shortName, _, _ := strings.Cut(dnsName, ".")
+		switch {
+		case addrErr == nil && slices.Contains(peer.TailscaleIPs, addr),
+			dnsName != "" && name == dnsName:
+			exact = append(exact, peer)
+		case shortName != "" && name == shortName,
+			name == strings.ToLower(peer.HostName):
+			if c.IsShared(peer.DNSName) {
+				shared = append(shared, peer)
+			} else {
+				short = append(short, peer)
+			}
+		}
+	}
+	for _, matches := range [][]*ipnstate.PeerStatus{exact, short, shared} {
+		switch len(matches) {
+		case 0:
+			continue
+		case 1:
+			if len(matches[0].TailscaleIPs) == 0 {
+				return nil, fmt.Errorf("no Tailscale addresses found for %s", host)
+			}
+			return slices.Clone(matches[0].TailscaleIPs), nil
+		default:
+			return nil, fmt.Errorf("%s matches %d peers", host, len(matches))
 		}
 	}
-	// If no A records found, return an error
-	return netip.Addr{}, fmt.Errorf("no A record found for %s", host)
+	return nil, fmt.Errorf("no peer found for %s", host)
+}
+
+// ResolveHost resolves the hostname to its Tailscale addresses using the
+// configured resolver. In auto mode MagicDNS is used when enabled, with the
+// netmap as a fallback.
+func (c *TSClient) ResolveHost(ctx context.Context, host string) ([]netip.Addr, error) {
+	switch c.Resolver {
+	case ResolveDNS:
+		return c.QueryTSDNS(ctx, host)
+	case ResolveNetmap:
+		return c.QueryNetmap(ctx, host)
+	}
+	if c.MagicDNS {
+		ips, err := c.QueryTSDNS(ctx, host)
+		if err == nil {
+			return ips, nil
+		}
+	}
+	return c.QueryNetmap(ctx, host)
 }
 
 // GetSSHHostKeys retrieves the SSH host keys for the given IP address.
@@ -71,24 +193,199 @@ func (c *TSClient) GetSSHHostKeys(ctx context.Context, ip netip.Addr) (*Tailscal
 	}
 
 	tsHost := &TailscaleHost{
-		Name: host.Node.Name,
-		IP:   ip,
+		Name:       host.Node.Name,
+		NodeID:     string(host.Node.StableID),
+		IPs:        c.nodeAddresses(ctx, host.Node.Addresses, ip),
+		Shared:     c.IsShared(host.Node.Name),
+		Tags:       slices.Clone(host.Node.Tags),
+		OS:         host.Node.Hostinfo.OS(),
+		KeyExpiry:  host.Node.KeyExpiry,
+		Authorized: host.Node.MachineAuthorized,
+		Expired:    host.Node.Expired,
+	}
+	if host.UserProfile != nil {
+		tsHost.Owner = host.UserProfile.LoginName
+	}
+	if host.Node.Online != nil {
+		tsHost.Online = *host.Node.Online
+	}
+	if host.Node.LastSeen != nil {
+		tsHost.LastSeen = *host.Node.LastSeen
 	}
 	if !host.Node.Hostinfo.TailscaleSSHEnabled() {
-		return tsHost, fmt.Errorf("Tailscale SSH is not enabled for %s", tsHost.Name)
+		return tsHost, &SSHNotEnabledError{Host: tsHost.Name}
+	}
+
+	lockStatus, err := c.lockStatus(ctx)
+	if err != nil {
+		return tsHost, err
+	}
+	if err := c.verifyNodeKey(lockStatus, tsHost.Name, host.Node.Key); err != nil {
+		return tsHost, err
 	}
 
 	// Parse the SSH host keys from the Hostinfo
-	keys := make(map[string]ssh.PublicKey)
-	for _, keyStr := range host.Node.Hostinfo.SSH_HostKeys().AsSlice() {
+	keys, err := parseHostKeys(host.Node.Hostinfo.SSH_HostKeys().AsSlice())
+	if err != nil {
+		return tsHost, fmt.Errorf("failed to parse SSH host key for %s: %w", ip, err)
+	}
+	tsHost.Keys = keys
+	return tsHost, nil
+}
+
+// lockStatus returns the Tailnet Lock status, or nil if Tailnet Lock
+// verification is disabled.
+func (c *TSClient) lockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error) {
+	if c.TailnetLock == "" || c.TailnetLock == LockOff {
+		return nil, nil
+	}
+	status, err := c.Client.NetworkLockStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Tailnet Lock status: %w", err)
+	}
+	return status, nil
+}
+
+// verifyNodeKey checks that the node key has a Tailnet Lock signature from a
+// trusted key. A nil status skips verification.
+func (c *TSClient) verifyNodeKey(status *ipnstate.NetworkLockStatus, host string, nodeKey key.NodePublic) error {
+	if status == nil {
+		return nil
+	}
+	if !status.Enabled {
+		if c.TailnetLock == LockRequire {
+			return &TailnetLockError{Host: host, Reason: "Tailnet Lock is not enabled"}
+		}
+		return nil
+	}
+	// This node is never one of its own visible peers, and is already trusted
+	// by being part of the locked tailnet
+	if status.NodeKey != nil && *status.NodeKey == nodeKey {
+		return nil
+	}
+	for _, peer := range status.FilteredPeers {
+		if peer.NodeKey == nodeKey {
+			return &TailnetLockError{Host: host, Reason: "node key failed Tailnet Lock verification"}
+		}
+	}
+	idx := slices.IndexFunc(status.VisiblePeers, func(peer *ipnstate.TKAPeer) bool {
+		return peer.NodeKey == nodeKey
+	})
+	if idx < 0 {
+		return &TailnetLockError{Host: host, Reason: "node key is not signed"}
+	}
+	keyID, err := status.VisiblePeers[idx].NodeKeySignature.UnverifiedAuthorizingKeyID()
+	if err != nil {
+		return &TailnetLockError{Host: host, Reason: err.Error()}
+	}
+	// tailscaled has already verified the signature, make sure it was made by
+	// a key that is still trusted
+	for _, trusted := range status.TrustedKeys {
+		if bytes.Equal(trusted.Key.KeyID(), keyID) {
+			return nil
+		}
+	}
+	return &TailnetLockError{Host: host, Reason: "node key is not signed by a trusted key"}
+}
+
+// parseHostKeys parses authorized_keys formatted host keys. Every key is kept,
+// a node may advertise several keys of one type while rotating them. Keys are
+// sorted by type and then by their encoding so the order doesn't depend on
+// the order they were advertised in, and duplicates are dropped.
+func parseHostKeys(hostKeys []string) ([]ssh.PublicKey, error) {
+	keys := make([]ssh.PublicKey, 0, len(hostKeys))
+	for _, keyStr := range hostKeys {
 		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyStr))
 		if err != nil {
-			return tsHost, fmt.Errorf("failed to parse SSH host key for %s: %w", ip, err)
+			return nil, err
 		}
-		keys[key.Type()] = key
+		keys = append(keys, key)
 	}
-	tsHost.Keys = keys
-	return tsHost, nil
+	slices.SortFunc(keys, func(a, b ssh.PublicKey) int {
+		return cmp.Or(strings.Compare(a.Type(), b.Type()), bytes.Compare(a.Marshal(), b.Marshal()))
+	})
+	return slices.CompactFunc(keys, func(a, b ssh.PublicKey) bool {
+		return bytes.Equal(a.Marshal(), b.Marshal())
+	}), nil
+}
+
+// GetAllHosts returns every peer in the tailnet that advertises SSH host keys,
+// or every peer if AllPeers is set, and matches the given filter. This node
+// is included if Self is set. Hosts are sorted by name.
+func (c *TSClient) GetAllHosts(ctx context.Context, filter PeerFilter) ([]*TailscaleHost, error) {
+	status, err := c.Client.Status(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Tailscale status: %w", err)
+	}
+
+	lockStatus, err := c.lockStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]*ipnstate.PeerStatus, 0, len(status.Peer)+1)
+	if filter.Self && status.Self != nil {
+		peers = append(peers, status.Self)
+	}
+	for _, peer := range status.Peer {
+		peers = append(peers, peer)
+	}
+
+	var hosts []*TailscaleHost
+	for _, peer := range peers {
+		if peer == nil || (len(peer.SSH_HostKeys) == 0 && !filter.AllPeers) || !filter.Match(peer) {
+			continue
+		}
+		// Peers that fail Tailnet Lock are left out rather than failing the
+		// whole listing
+		if err := c.verifyNodeKey(lockStatus, peer.DNSName, peer.PublicKey); err != nil {
+			continue
+		}
+		keys, err := parseHostKeys(peer.SSH_HostKeys)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SSH host key for %s: %w", peer.DNSName, err)
+		}
+		tsHost := &TailscaleHost{
+			Name:   peer.DNSName,
+			NodeID: string(peer.ID),
+			IPs:    slices.Clone(peer.TailscaleIPs),
+			Keys:   keys,
+			Shared: c.IsShared(peer.DNSName),
+			OS:     peer.OS,
+			Owner:  status.User[peer.UserID].LoginName,
+			// Unauthorized machines are not sent to peers in the netmap
+			Authorized: true,
+			Expired:    peer.Expired,
+			Online:     peer.Online,
+			LastSeen:   peer.LastSeen,
+		}
+		if peer.Tags != nil {
+			tsHost.Tags = peer.Tags.AsSlice()
+		}
+		if peer.KeyExpiry != nil {
+			tsHost.KeyExpiry = *peer.KeyExpiry
+		}
+		hosts = append(hosts, tsHost)
+	}
+	slices.SortFunc(hosts, func(a, b *TailscaleHost) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return hosts, nil
+}
+
+// nodeAddresses returns all Tailscale addresses assigned to a node. If the node
+// reports no addresses the queried IP is used instead.
+func (c *TSClient) nodeAddresses(ctx context.Context, prefixes []netip.Prefix, ip netip.Addr) []netip.Addr {
+	var ips []netip.Addr
+	for _, p := range prefixes {
+		if addr := p.Addr(); c.IsTailscaleNode(ctx, addr) {
+			ips = append(ips, addr)
+		}
+	}
+	if len(ips) == 0 {
+		ips = append(ips, ip)
+	}
+	return ips
 }
 
 // Check IP is a Tailscale node
@@ -97,25 +394,33 @@ func (c *TSClient) IsTailscaleNode(ctx context.Context, ip netip.Addr) bool {
 }
 
 // GetHost returns the Tailscale host information for the given IP address.
+// If the node doesn't have Tailscale SSH enabled it is returned without keys
+// along with an SSHNotEnabledError.
 func (c *TSClient) GetHost(ctx context.Context, host string) (*TailscaleHost, error) {
-	ip, err := netip.ParseAddr(host)
-	if err != nil {
+	var ip netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		ip = addr
+	} else {
 		// The host is not an IP, assume it's a hostname
-		if !strings.HasSuffix(host, c.Tailnet) {
-			host = host + "." + c.Tailnet
-		}
-		ip, err = c.QueryTSDNS(ctx, host)
+		ips, err := c.ResolveHost(ctx, host)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve %s: %w", host, err)
+			return nil, &InvalideTailscaleNameError{Host: host, Err: err}
 		}
+		ip = ips[0]
 	}
 	if !c.IsTailscaleNode(ctx, ip) {
-		return nil, fmt.Errorf("%s is not a Tailscale node", host)
+		return nil, fmt.Errorf("%s is not a Tailscale node: %w", host, &InvalidTailscaleIPError{IP: ip})
 	}
 
 	tsHost, err := c.GetSSHHostKeys(ctx, ip)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get SSH host keys for %s: %w", host, err)
+		// A node without Tailscale SSH is returned with the error, so callers
+		// can still report what the node is
+		var noSSH *SSHNotEnabledError
+		if !errors.As(err, &noSSH) {
+			tsHost = nil
+		}
+		return tsHost, fmt.Errorf("failed to get SSH host keys for %s: %w", host, err)
 	}
 
 	return tsHost, nil
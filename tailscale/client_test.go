@@ -2,16 +2,24 @@ package tailscale
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/netip"
+	"strings"
 	"testing"
+	"time"
 
 	in "github.com/evilhamsterman/tailshale/internal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tka"
 	"tailscale.com/types/dnstype"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
 )
 
 var _ Client = (*in.MockClient)(nil) // Ensure MockClient implements the Client interface
@@ -20,7 +28,8 @@ func TestNewTSClient(t *testing.T) {
 	m := new(in.MockClient)
 	m.On("Status", mock.Anything).Return(&ipnstate.Status{
 		CurrentTailnet: &ipnstate.TailnetStatus{
-			MagicDNSSuffix: in.TEST_TAILNET,
+			MagicDNSSuffix:  in.TEST_TAILNET,
+			MagicDNSEnabled: true,
 		},
 	}, nil)
 
@@ -29,6 +38,7 @@ func TestNewTSClient(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotNil(t, client)
 	assert.Equal(t, in.TEST_TAILNET, client.Tailnet)
+	assert.True(t, client.MagicDNS)
 }
 
 func TestQueryDNS(t *testing.T) {
@@ -37,16 +47,20 @@ func TestQueryDNS(t *testing.T) {
 	m := new(in.MockClient)
 	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "A").Return(
 		msg, []*dnstype.Resolver{}, nil)
+	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "AAAA").Return(
+		in.GetTestDNSMessageAAAA(), []*dnstype.Resolver{}, nil)
 
 	c := &TSClient{
 		Client:  m,
 		Tailnet: in.TEST_TAILNET,
 	}
-	ip, err := c.QueryTSDNS(context.TODO(), "test.example.ts.net")
+	ips, err := c.QueryTSDNS(context.TODO(), "test.example.ts.net")
 	m.AssertExpectations(t)
 	assert.NoError(t, err)
-	assert.NotNil(t, ip)
-	assert.Equal(t, netip.MustParseAddr("100.100.100.100"), ip)
+	assert.Equal(t, []netip.Addr{
+		netip.MustParseAddr("100.100.100.100"),
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+	}, ips)
 }
 
 func TestGetSSHHostKeys(t *testing.T) {
@@ -64,9 +78,12 @@ func TestGetSSHHostKeys(t *testing.T) {
 	m.AssertExpectations(t)
 	assert.NoError(t, err)
 	assert.Equal(t, "test."+in.TEST_TAILNET, host.Name)
-	assert.Equal(t, in.TEST_IP, host.IP)
+	assert.Equal(t, []netip.Addr{in.TEST_IP, in.TEST_IP6}, host.IPs)
 	require.Len(t, host.Keys, 1)
-	assert.Equal(t, in.TEST_HOST_KEY_OBJECT, host.Keys[ED25519])
+	assert.Equal(t, in.TEST_HOST_KEY_OBJECT, host.Keys[0])
+	assert.Equal(t, []string{"tag:server"}, host.Tags)
+	assert.Equal(t, "linux", host.OS)
+	assert.True(t, host.Authorized)
 }
 
 func TestGetSSHHostKeys_NoSSH(t *testing.T) {
@@ -87,6 +104,25 @@ func TestGetSSHHostKeys_NoSSH(t *testing.T) {
 	assert.Nil(t, host.Keys)
 }
 
+func TestGetHost_NoSSH(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("WhoIs", context.TODO(), in.TEST_IP.String()).Return(
+		&apitype.WhoIsResponse{
+			Node: in.GetTestNode(nil)},
+		nil)
+	c := &TSClient{
+		Client:  m,
+		Tailnet: in.TEST_TAILNET,
+	}
+
+	host, err := c.GetHost(context.TODO(), in.TEST_IP.String())
+	var noSSH *SSHNotEnabledError
+	assert.ErrorAs(t, err, &noSSH)
+	require.NotNil(t, host, "The node should still be described")
+	assert.Equal(t, []string{"tag:server"}, host.Tags)
+	assert.False(t, host.Record().SSHEnabled)
+}
+
 func TestIsTailcaleNode(t *testing.T) {
 	c := &TSClient{
 		Tailnet: in.TEST_TAILNET,
@@ -117,13 +153,16 @@ func TestGetHost_FQDN(t *testing.T) {
 	m := new(in.MockClient)
 	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "A").Return(
 		in.GetTestDNSMessage(), []*dnstype.Resolver{}, nil)
+	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "AAAA").Return(
+		in.GetTestDNSMessageAAAA(), []*dnstype.Resolver{}, nil)
 	m.On("WhoIs", context.TODO(), in.TEST_IP.String()).Return(
 		&apitype.WhoIsResponse{
 			Node: in.GetTestNode([]string{in.TEST_HOST_KEY})},
 		nil)
 	c := &TSClient{
-		Client:  m,
-		Tailnet: in.TEST_TAILNET,
+		Client:   m,
+		Tailnet:  in.TEST_TAILNET,
+		MagicDNS: true,
 	}
 
 	host, err := c.GetHost(context.TODO(), "test.example.ts.net")
@@ -131,7 +170,8 @@ func TestGetHost_FQDN(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, host)
 	assert.Equal(t, "test.example.ts.net", host.Name)
-	assert.Equal(t, in.TEST_IP, host.IP)
+	assert.Equal(t, in.TEST_NODE_ID, host.NodeID)
+	assert.Equal(t, []netip.Addr{in.TEST_IP, in.TEST_IP6}, host.IPs)
 	assert.Len(t, host.Keys, 1)
 }
 
@@ -139,13 +179,16 @@ func TestGetHost_Hostname(t *testing.T) {
 	m := new(in.MockClient)
 	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "A").Return(
 		in.GetTestDNSMessage(), []*dnstype.Resolver{}, nil)
+	m.On("QueryDNS", context.TODO(), "test.example.ts.net", "AAAA").Return(
+		in.GetTestDNSMessageAAAA(), []*dnstype.Resolver{}, nil)
 	m.On("WhoIs", context.TODO(), in.TEST_IP.String()).Return(
 		&apitype.WhoIsResponse{
 			Node: in.GetTestNode([]string{in.TEST_HOST_KEY})},
 		nil)
 	c := &TSClient{
-		Client:  m,
-		Tailnet: in.TEST_TAILNET,
+		Client:   m,
+		Tailnet:  in.TEST_TAILNET,
+		MagicDNS: true,
 	}
 
 	host, err := c.GetHost(context.TODO(), "test")
@@ -153,7 +196,7 @@ func TestGetHost_Hostname(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, host)
 	assert.Equal(t, "test.example.ts.net", host.Name)
-	assert.Equal(t, in.TEST_IP, host.IP)
+	assert.Equal(t, []netip.Addr{in.TEST_IP, in.TEST_IP6}, host.IPs)
 	assert.Len(t, host.Keys, 1)
 }
 
@@ -174,6 +217,411 @@ func TestGetHost_IP(t *testing.T) {
 	require.NoError(t, err)
 	assert.NotNil(t, host)
 	assert.Equal(t, "test.example.ts.net", host.Name, "Expected host name to be resolved from IP")
-	assert.Equal(t, in.TEST_IP, host.IP)
+	assert.Equal(t, []netip.Addr{in.TEST_IP, in.TEST_IP6}, host.IPs)
 	assert.Len(t, host.Keys, 1)
 }
+
+func TestGetHost_IPv6(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("WhoIs", context.TODO(), in.TEST_IP6.String()).Return(
+		&apitype.WhoIsResponse{
+			Node: in.GetTestNode([]string{in.TEST_HOST_KEY})},
+		nil)
+	c := &TSClient{
+		Client:  m,
+		Tailnet: in.TEST_TAILNET,
+	}
+
+	host, err := c.GetHost(context.TODO(), in.TEST_IP6.String())
+	m.AssertExpectations(t)
+	require.NoError(t, err)
+	assert.Equal(t, "test.example.ts.net", host.Name)
+	assert.Equal(t, []netip.Addr{in.TEST_IP, in.TEST_IP6}, host.IPs)
+	assert.Len(t, host.Keys, 1)
+}
+
+func TestGetAllHosts(t *testing.T) {
+	tags := views.SliceOf([]string{"tag:server"})
+	m := new(in.MockClient)
+	m.On("Status", context.TODO()).Return(&ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			DNSName:      "self." + in.TEST_TAILNET + ".",
+			OS:           "linux",
+			Online:       true,
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.103")},
+			SSH_HostKeys: []string{in.TEST_HOST_KEY},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				OS:           "linux",
+				Online:       true,
+				Tags:         &tags,
+				TailscaleIPs: []netip.Addr{in.TEST_IP, in.TEST_IP6},
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "laptop." + in.TEST_TAILNET + ".",
+				OS:           "macOS",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.101")},
+				SSH_HostKeys: []string{in.TEST_HOST_KEY},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "nossh." + in.TEST_TAILNET + ".",
+				OS:           "linux",
+				Online:       true,
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.102")},
+			},
+		},
+	}, nil)
+	c := &TSClient{
+		Client:  m,
+		Tailnet: in.TEST_TAILNET,
+	}
+
+	tests := []struct {
+		name     string
+		filter   PeerFilter
+		expected []string
+	}{
+		{
+			name:     "No filter",
+			filter:   PeerFilter{},
+			expected: []string{"laptop.example.ts.net.", "test.example.ts.net."},
+		},
+		{
+			name:     "Tag",
+			filter:   PeerFilter{Tags: []string{"server"}},
+			expected: []string{"test.example.ts.net."},
+		},
+		{
+			name:     "OS",
+			filter:   PeerFilter{OS: "macos"},
+			expected: []string{"laptop.example.ts.net."},
+		},
+		{
+			name:     "Online",
+			filter:   PeerFilter{Online: true},
+			expected: []string{"test.example.ts.net."},
+		},
+		{
+			name:     "All peers",
+			filter:   PeerFilter{AllPeers: true},
+			expected: []string{"laptop.example.ts.net.", "nossh.example.ts.net.", "test.example.ts.net."},
+		},
+		{
+			name:     "Self",
+			filter:   PeerFilter{Self: true, OS: "linux"},
+			expected: []string{"self.example.ts.net.", "test.example.ts.net."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, err := c.GetAllHosts(context.TODO(), tt.filter)
+			require.NoError(t, err)
+			var names []string
+			for _, h := range hosts {
+				names = append(names, h.Name)
+			}
+			assert.Equal(t, tt.expected, names)
+		})
+	}
+}
+
+func TestQueryNetmap(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("Status", context.TODO()).Return(&ipnstate.Status{
+		Self: &ipnstate.PeerStatus{
+			HostName:     "self",
+			DNSName:      "self." + in.TEST_TAILNET + ".",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.1")},
+		},
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				HostName:     "Test-Machine",
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{in.TEST_IP, in.TEST_IP6},
+			},
+			key.NewNode().Public(): {
+				HostName:     "dup",
+				DNSName:      "dup-1." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.2")},
+			},
+			key.NewNode().Public(): {
+				HostName:     "dup",
+				DNSName:      "dup-2." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.3")},
+			},
+		},
+	}, nil)
+	c := &TSClient{
+		Client:  m,
+		Tailnet: in.TEST_TAILNET,
+	}
+
+	tests := []struct {
+		host     string
+		expected []netip.Addr
+		err      bool
+	}{
+		{host: "test.example.ts.net", expected: []netip.Addr{in.TEST_IP, in.TEST_IP6}},
+		{host: "test.example.ts.net.", expected: []netip.Addr{in.TEST_IP, in.TEST_IP6}},
+		{host: "test", expected: []netip.Addr{in.TEST_IP, in.TEST_IP6}},
+		{host: "test-machine", expected: []netip.Addr{in.TEST_IP, in.TEST_IP6}},
+		{host: in.TEST_IP6.String(), expected: []netip.Addr{in.TEST_IP, in.TEST_IP6}},
+		{host: "self", expected: []netip.Addr{netip.MustParseAddr("100.100.100.1")}},
+		{host: "dup-2", expected: []netip.Addr{netip.MustParseAddr("100.100.100.3")}},
+		{host: "dup", err: true},
+		{host: "missing", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ips, err := c.QueryNetmap(context.TODO(), tt.host)
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, ips)
+		})
+	}
+}
+
+func TestResolveHost_Fallback(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("QueryDNS", context.TODO(), "test.example.ts.net", mock.Anything).Return(
+		[]byte{}, []*dnstype.Resolver{}, errors.New("MagicDNS unavailable"))
+	m.On("Status", context.TODO()).Return(&ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{in.TEST_IP},
+			},
+		},
+	}, nil)
+
+	t.Run("Auto", func(t *testing.T) {
+		c := &TSClient{Client: m, Tailnet: in.TEST_TAILNET, MagicDNS: true}
+		ips, err := c.ResolveHost(context.TODO(), "test")
+		require.NoError(t, err)
+		assert.Equal(t, []netip.Addr{in.TEST_IP}, ips)
+	})
+
+	t.Run("DNS only", func(t *testing.T) {
+		c := &TSClient{Client: m, Tailnet: in.TEST_TAILNET, MagicDNS: true, Resolver: ResolveDNS}
+		_, err := c.ResolveHost(context.TODO(), "test")
+		assert.Error(t, err)
+	})
+}
+
+func TestSharedNodes(t *testing.T) {
+	m := new(in.MockClient)
+	m.On("Status", context.TODO()).Return(&ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "test." + in.TEST_TAILNET + ".",
+				TailscaleIPs: []netip.Addr{in.TEST_IP},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "test.other.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.2")},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "shared.other.ts.net.",
+				TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.100.100.3")},
+			},
+		},
+	}, nil)
+	c := &TSClient{
+		Client:  m,
+		Tailnet: in.TEST_TAILNET,
+	}
+
+	assert.False(t, c.IsShared("test.example.ts.net."))
+	assert.True(t, c.IsShared("test.other.ts.net."))
+	assert.Equal(t, "test.example.ts.net", c.qualify("test"))
+	assert.Equal(t, "test.other.ts.net", c.qualify("test.other.ts.net."))
+
+	tests := []struct {
+		host     string
+		expected netip.Addr
+	}{
+		{host: "test", expected: in.TEST_IP},
+		{host: "test.other.ts.net", expected: netip.MustParseAddr("100.100.100.2")},
+		{host: "shared", expected: netip.MustParseAddr("100.100.100.3")},
+		{host: "shared.other.ts.net.", expected: netip.MustParseAddr("100.100.100.3")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			ips, err := c.QueryNetmap(context.TODO(), tt.host)
+			require.NoError(t, err)
+			assert.Equal(t, []netip.Addr{tt.expected}, ips)
+		})
+	}
+}
+
+func TestVerifyTailnetLock(t *testing.T) {
+	trusted := key.NewNLPrivate().Public()
+	untrusted := key.NewNLPrivate().Public()
+	signed := key.NewNode().Public()
+	badSigner := key.NewNode().Public()
+	filtered := key.NewNode().Public()
+	unknown := key.NewNode().Public()
+	self := key.NewNode().Public()
+
+	status := &ipnstate.NetworkLockStatus{
+		Enabled:     true,
+		NodeKey:     &self,
+		TrustedKeys: []ipnstate.TKAKey{{Key: trusted}},
+		VisiblePeers: []*ipnstate.TKAPeer{
+			{
+				NodeKey:          signed,
+				NodeKeySignature: tka.NodeKeySignature{SigKind: tka.SigDirect, KeyID: trusted.KeyID()},
+			},
+			{
+				NodeKey:          badSigner,
+				NodeKeySignature: tka.NodeKeySignature{SigKind: tka.SigDirect, KeyID: untrusted.KeyID()},
+			},
+		},
+		FilteredPeers: []*ipnstate.TKAPeer{
+			{NodeKey: filtered},
+		},
+	}
+
+	c := &TSClient{TailnetLock: LockAuto}
+	tests := []struct {
+		name    string
+		nodeKey key.NodePublic
+		ok      bool
+	}{
+		{"Signed", signed, true},
+		{"Untrusted signer", badSigner, false},
+		{"Filtered", filtered, false},
+		{"Unsigned", unknown, false},
+		{"Self", self, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := c.verifyNodeKey(status, "test", tt.nodeKey)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				var lockErr *TailnetLockError
+				assert.ErrorAs(t, err, &lockErr)
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		disabled := &ipnstate.NetworkLockStatus{}
+		assert.NoError(t, c.verifyNodeKey(disabled, "test", unknown))
+		strict := &TSClient{TailnetLock: LockRequire}
+		assert.Error(t, strict.verifyNodeKey(disabled, "test", unknown))
+	})
+}
+
+func TestGetSSHHostKeys_TailnetLock(t *testing.T) {
+	node := in.GetTestNode([]string{in.TEST_HOST_KEY})
+	node.Key = key.NewNode().Public()
+	m := new(in.MockClient)
+	m.On("WhoIs", context.TODO(), in.TEST_IP.String()).Return(
+		&apitype.WhoIsResponse{Node: node}, nil)
+	m.On("NetworkLockStatus", context.TODO()).Return(
+		&ipnstate.NetworkLockStatus{Enabled: true}, nil)
+
+	c := &TSClient{
+		Client:      m,
+		Tailnet:     in.TEST_TAILNET,
+		TailnetLock: LockAuto,
+	}
+	_, err := c.GetSSHHostKeys(context.TODO(), in.TEST_IP)
+	m.AssertExpectations(t)
+	var lockErr *TailnetLockError
+	assert.ErrorAs(t, err, &lockErr)
+}
+
+func TestTailscaleHost_States(t *testing.T) {
+	now := time.Now()
+	h := &TailscaleHost{}
+	assert.False(t, h.KeyExpired(now), "Disabled key expiry should not expire")
+	assert.False(t, h.Stale(now, time.Hour), "Unknown last seen should not be stale")
+
+	h.KeyExpiry = now.Add(-time.Minute)
+	assert.True(t, h.KeyExpired(now))
+	h = &TailscaleHost{Expired: true}
+	assert.True(t, h.KeyExpired(now))
+
+	h = &TailscaleHost{LastSeen: now.Add(-2 * time.Hour)}
+	assert.True(t, h.Stale(now, time.Hour))
+	assert.False(t, h.Stale(now, 0), "Zero max age disables the check")
+	h.Online = true
+	assert.False(t, h.Stale(now, time.Hour), "Online nodes are never stale")
+}
+
+func TestTailscaleHost_JSON(t *testing.T) {
+	h := &TailscaleHost{
+		Name:       "test.example.ts.net.",
+		NodeID:     in.TEST_NODE_ID,
+		IPs:        []netip.Addr{in.TEST_IP, in.TEST_IP6},
+		Keys:       []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Tags:       []string{"tag:server"},
+		Authorized: true,
+	}
+	data, err := json.Marshal(h)
+	require.NoError(t, err)
+
+	decoded := &TailscaleHost{}
+	require.NoError(t, json.Unmarshal(data, decoded))
+	assert.Equal(t, h.Name, decoded.Name)
+	assert.Equal(t, h.NodeID, decoded.NodeID)
+	assert.Equal(t, h.IPs, decoded.IPs)
+	assert.Equal(t, h.Tags, decoded.Tags)
+	assert.True(t, decoded.Authorized)
+	assert.Equal(t, in.TEST_HOST_KEY_OBJECT.Marshal(), decoded.Keys[0].Marshal())
+}
+
+func TestTailscaleHost_Record(t *testing.T) {
+	h := &TailscaleHost{
+		Name:   "test.example.ts.net.",
+		IPs:    []netip.Addr{in.TEST_IP, in.TEST_IP6},
+		Keys:   []ssh.PublicKey{in.TEST_HOST_KEY_OBJECT},
+		Tags:   []string{"tag:server"},
+		Owner:  "user@example.com",
+		Online: true,
+	}
+	r := h.Record()
+	assert.Equal(t, "test.example.ts.net", r.Name)
+	assert.Equal(t, []string{in.TEST_IP.String(), in.TEST_IP6.String()}, r.IPs)
+	assert.Equal(t, []string{"tag:server"}, r.Tags)
+	assert.Equal(t, "user@example.com", r.Owner)
+	assert.True(t, r.Online)
+	assert.True(t, r.SSHEnabled)
+	require.Len(t, r.Keys, 1)
+	assert.Equal(t, ssh.KeyAlgoED25519, r.Keys[0].Type)
+	assert.Equal(t, ssh.FingerprintSHA256(in.TEST_HOST_KEY_OBJECT), r.Keys[0].Fingerprint)
+	assert.Equal(t, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(in.TEST_HOST_KEY_OBJECT))), r.Keys[0].AuthorizedKey)
+
+	empty := (&TailscaleHost{Name: "nossh.example.ts.net"}).Record()
+	assert.False(t, empty.SSHEnabled)
+	assert.NotNil(t, empty.Keys)
+}
+
+func TestParseHostKeys(t *testing.T) {
+	keys, err := parseHostKeys([]string{in.TEST_RSA_HOST_KEY, in.TEST_HOST_KEY_2, in.TEST_HOST_KEY, in.TEST_HOST_KEY})
+	require.NoError(t, err)
+	require.Len(t, keys, 3, "Keys of the same type should be kept and duplicates dropped")
+	assert.Equal(t, []string{ED25519, ED25519, RSA}, []string{keys[0].Type(), keys[1].Type(), keys[2].Type()})
+
+	reordered, err := parseHostKeys([]string{in.TEST_HOST_KEY, in.TEST_HOST_KEY_2, in.TEST_RSA_HOST_KEY})
+	require.NoError(t, err)
+	assert.Equal(t, keys, reordered, "Order should not depend on the advertised order")
+
+	host := &TailscaleHost{Keys: keys}
+	assert.Len(t, host.KeysOfType(ED25519), 2)
+	assert.Equal(t, []string{ED25519, RSA}, host.KeyTypes())
+
+	_, err = parseHostKeys([]string{"bogus"})
+	assert.Error(t, err)
+}
@@ -2,7 +2,12 @@ package tailscale
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"net/netip"
+	"slices"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"tailscale.com/client/tailscale/apitype"
@@ -30,16 +35,57 @@ type Client interface {
 	Status(ctx context.Context) (*ipnstate.Status, error)
 	QueryDNS(ctx context.Context, host string, qtype string) ([]byte, []*dnstype.Resolver, error)
 	WhoIs(ctx context.Context, ip string) (*apitype.WhoIsResponse, error)
+	NetworkLockStatus(ctx context.Context) (*ipnstate.NetworkLockStatus, error)
 }
 
+// ResolveMode selects how hostnames are resolved to Tailscale addresses.
+type ResolveMode string
+
+const (
+	// ResolveAuto uses MagicDNS when it is enabled and falls back to the netmap
+	ResolveAuto ResolveMode = "auto"
+	// ResolveDNS only uses MagicDNS
+	ResolveDNS ResolveMode = "dns"
+	// ResolveNetmap only matches against the peers in the netmap
+	ResolveNetmap ResolveMode = "netmap"
+)
+
+// LockMode selects how Tailnet Lock signatures are verified.
+type LockMode string
+
+const (
+	// LockOff does not verify Tailnet Lock signatures
+	LockOff LockMode = "off"
+	// LockAuto verifies signatures when Tailnet Lock is enabled
+	LockAuto LockMode = "auto"
+	// LockRequire verifies signatures and fails if Tailnet Lock is not enabled
+	LockRequire LockMode = "require"
+)
+
+// HostGetter looks up Tailscale hosts by name or IP address.
+type HostGetter interface {
+	GetHost(ctx context.Context, host string) (*TailscaleHost, error)
+}
+
+// ErrUnavailable is returned when tailscaled can not be reached.
+var ErrUnavailable = errors.New("tailscaled is unavailable")
+
 type InvalideTailscaleNameError struct {
 	Host string
+	Err  error
 }
 
 func (e *InvalideTailscaleNameError) Error() string {
+	if e.Err != nil {
+		return "invalid Tailscale name: " + e.Host + ": " + e.Err.Error()
+	}
 	return "invalid Tailscale name: " + e.Host
 }
 
+func (e *InvalideTailscaleNameError) Unwrap() error {
+	return e.Err
+}
+
 type InvalidTailscaleIPError struct {
 	IP netip.Addr
 }
@@ -48,8 +94,235 @@ func (e *InvalidTailscaleIPError) Error() string {
 	return "invalid Tailscale IP address: " + e.IP.String()
 }
 
+// SSHNotEnabledError is returned when a node does not have Tailscale SSH
+// enabled and so advertises no host keys.
+type SSHNotEnabledError struct {
+	Host string
+}
+
+func (e *SSHNotEnabledError) Error() string {
+	return "Tailscale SSH is not enabled for " + e.Host
+}
+
+// TailnetLockError is returned when a node key does not pass Tailnet Lock
+// verification.
+type TailnetLockError struct {
+	Host   string
+	Reason string
+}
+
+func (e *TailnetLockError) Error() string {
+	return "Tailnet Lock verification failed for " + e.Host + ": " + e.Reason
+}
+
 type TailscaleHost struct {
-	Name string
-	IP   netip.Addr
-	Keys map[string]ssh.PublicKey // Key type to public key mapping
+	Name       string
+	NodeID     string          // Stable node ID, unchanged by renames and new IPs
+	IPs        []netip.Addr    // All Tailscale addresses of the node
+	Keys       []ssh.PublicKey // All advertised host keys, ordered by type
+	Shared     bool            // Node is shared in from another tailnet
+	Tags       []string        // ACL tags of the node
+	Owner      string          // Login name of the node owner
+	OS         string          // OS reported in the node Hostinfo
+	KeyExpiry  time.Time       // Zero if key expiry is disabled
+	Authorized bool            // Machine is authorized in the tailnet
+	Expired    bool            // Node key has expired according to control
+	Online     bool            // Node is connected to control
+	LastSeen   time.Time       // Last time the node was connected, if known
+}
+
+// tailscaleHostJSON is the serialized form of a TailscaleHost. Keys are stored
+// in authorized_keys format.
+type tailscaleHostJSON struct {
+	Name       string       `json:"name"`
+	NodeID     string       `json:"node_id,omitempty"`
+	IPs        []netip.Addr `json:"ips"`
+	Keys       []string     `json:"keys"`
+	Shared     bool         `json:"shared,omitempty"`
+	Tags       []string     `json:"tags,omitempty"`
+	Owner      string       `json:"owner,omitempty"`
+	OS         string       `json:"os,omitempty"`
+	KeyExpiry  time.Time    `json:"key_expiry"`
+	Authorized bool         `json:"authorized"`
+	Expired    bool         `json:"expired,omitempty"`
+	Online     bool         `json:"online"`
+	LastSeen   time.Time    `json:"last_seen"`
+}
+
+func (h TailscaleHost) MarshalJSON() ([]byte, error) {
+	j := tailscaleHostJSON{
+		Name:       h.Name,
+		NodeID:     h.NodeID,
+		IPs:        h.IPs,
+		Shared:     h.Shared,
+		Tags:       h.Tags,
+		Owner:      h.Owner,
+		OS:         h.OS,
+		KeyExpiry:  h.KeyExpiry,
+		Authorized: h.Authorized,
+		Expired:    h.Expired,
+		Online:     h.Online,
+		LastSeen:   h.LastSeen,
+	}
+	for _, key := range h.Keys {
+		j.Keys = append(j.Keys, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))))
+	}
+	return json.Marshal(j)
+}
+
+func (h *TailscaleHost) UnmarshalJSON(data []byte) error {
+	var j tailscaleHostJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	keys, err := parseHostKeys(j.Keys)
+	if err != nil {
+		return err
+	}
+	*h = TailscaleHost{
+		Name:       j.Name,
+		NodeID:     j.NodeID,
+		IPs:        j.IPs,
+		Keys:       keys,
+		Shared:     j.Shared,
+		Tags:       j.Tags,
+		Owner:      j.Owner,
+		OS:         j.OS,
+		KeyExpiry:  j.KeyExpiry,
+		Authorized: j.Authorized,
+		Expired:    j.Expired,
+		Online:     j.Online,
+		LastSeen:   j.LastSeen,
+	}
+	return nil
+}
+
+// HostKeyRecord is the serializable form of a single SSH host key.
+type HostKeyRecord struct {
+	Type          string `json:"type" yaml:"type"`
+	AuthorizedKey string `json:"authorized_key" yaml:"authorized_key"`
+	Fingerprint   string `json:"fingerprint" yaml:"fingerprint"`
+}
+
+// NewHostKeyRecord returns the serializable form of the key.
+func NewHostKeyRecord(key ssh.PublicKey) HostKeyRecord {
+	return HostKeyRecord{
+		Type:          key.Type(),
+		AuthorizedKey: strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+		Fingerprint:   ssh.FingerprintSHA256(key),
+	}
+}
+
+// HostRecord is the serializable form of a TailscaleHost used for machine
+// readable output. Query is the name the host was looked up by and Error is
+// set when that lookup failed or the host was rejected.
+type HostRecord struct {
+	Query      string          `json:"query,omitempty" yaml:"query,omitempty"`
+	Name       string          `json:"name,omitempty" yaml:"name,omitempty"`
+	NodeID     string          `json:"node_id,omitempty" yaml:"node_id,omitempty"`
+	IPs        []string        `json:"ips,omitempty" yaml:"ips,omitempty"`
+	Keys       []HostKeyRecord `json:"keys" yaml:"keys"`
+	Tags       []string        `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Owner      string          `json:"owner,omitempty" yaml:"owner,omitempty"`
+	OS         string          `json:"os,omitempty" yaml:"os,omitempty"`
+	Online     bool            `json:"online" yaml:"online"`
+	SSHEnabled bool            `json:"ssh_enabled" yaml:"ssh_enabled"`
+	Error      string          `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Record returns the serializable form of the host.
+func (h *TailscaleHost) Record() HostRecord {
+	r := HostRecord{
+		Name:       strings.TrimSuffix(h.Name, "."),
+		NodeID:     h.NodeID,
+		Keys:       []HostKeyRecord{},
+		Tags:       h.Tags,
+		Owner:      h.Owner,
+		OS:         h.OS,
+		Online:     h.Online,
+		SSHEnabled: len(h.Keys) > 0,
+	}
+	for _, ip := range h.IPs {
+		r.IPs = append(r.IPs, ip.String())
+	}
+	for _, key := range h.Keys {
+		r.Keys = append(r.Keys, NewHostKeyRecord(key))
+	}
+	return r
+}
+
+// KeysOfType returns the host's keys of the given type.
+func (h *TailscaleHost) KeysOfType(keyType string) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for _, key := range h.Keys {
+		if key.Type() == keyType {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// KeyTypes returns the distinct types of the host's keys, in order.
+func (h *TailscaleHost) KeyTypes() []string {
+	var types []string
+	for _, key := range h.Keys {
+		if !slices.Contains(types, key.Type()) {
+			types = append(types, key.Type())
+		}
+	}
+	return types
+}
+
+// KeyExpired reports whether the node key has expired at the given time.
+func (h *TailscaleHost) KeyExpired(now time.Time) bool {
+	return h.Expired || (!h.KeyExpiry.IsZero() && now.After(h.KeyExpiry))
+}
+
+// Stale reports whether the node has been offline for longer than maxAge.
+func (h *TailscaleHost) Stale(now time.Time, maxAge time.Duration) bool {
+	if h.Online || h.LastSeen.IsZero() || maxAge <= 0 {
+		return false
+	}
+	return now.Sub(h.LastSeen) > maxAge
+}
+
+// PeerFilter selects peers from the tailnet status. Empty fields match all
+// peers.
+type PeerFilter struct {
+	Tags   []string // Peer must have at least one of these tags
+	OS     string   // Peer must run this OS, compared case-insensitively
+	Online bool     // Peer must currently be online
+	// AllPeers includes peers that do not advertise SSH host keys
+	AllPeers bool
+	// Self includes this node, if it matches the rest of the filter
+	Self bool
+}
+
+// Match reports whether the peer satisfies the filter.
+func (f PeerFilter) Match(peer *ipnstate.PeerStatus) bool {
+	if f.Online && !peer.Online {
+		return false
+	}
+	if f.OS != "" && !strings.EqualFold(f.OS, peer.OS) {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		if peer.Tags == nil {
+			return false
+		}
+		found := false
+		for _, tag := range f.Tags {
+			if !strings.HasPrefix(tag, "tag:") {
+				tag = "tag:" + tag
+			}
+			if slices.Contains(peer.Tags.AsSlice(), tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
 }